@@ -19,7 +19,7 @@ package common
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"fmt"
+	"strings"
 
 	"github.com/golang/glog"
 	"k8s.io/api/admissionregistration/v1beta1"
@@ -76,7 +76,7 @@ func getAPIServerCert(clientset *kubernetes.Clientset) []byte {
 
 	pem, ok := c.Data["client-ca-file"]
 	if !ok {
-		glog.Fatalf(fmt.Sprintf("cannot find the ca.crt in the configmap, configMap.Data is %#v", c.Data))
+		glog.Fatalf("cannot find the ca.crt in the configmap, configMap.Data is %#v", c.Data)
 	}
 	glog.V(4).Info("client-ca-file=", pem)
 	return []byte(pem)
@@ -147,6 +147,22 @@ func SelfPodValidatingWebHookRegistration(clientset *kubernetes.Clientset, confi
 							APIVersions: []string{"v1"},
 							Resources:   []string{"pods"},
 						},
+					},
+					{
+						Operations: []v1beta1.OperationType{v1beta1.Create, v1beta1.Update},
+						Rule: v1beta1.Rule{
+							APIGroups:   []string{"apps", "extensions"},
+							APIVersions: []string{"*"},
+							Resources:   []string{"deployments", "statefulsets", "daemonsets", "replicasets"},
+						},
+					},
+					{
+						Operations: []v1beta1.OperationType{v1beta1.Create, v1beta1.Update},
+						Rule: v1beta1.Rule{
+							APIGroups:   []string{"batch"},
+							APIVersions: []string{"*"},
+							Resources:   []string{"jobs", "cronjobs"},
+						},
 					}},
 				ClientConfig: config,
 			},
@@ -331,3 +347,197 @@ func SelfPodPriorityWebHookRegistration(clientset *kubernetes.Clientset, configN
 		glog.Infof("Self registration as MutatingWebhook %s succeeded.", configName)
 	}
 }
+
+// register the mutating part of nshostpathprivilege with the kube-apiserver
+// by creating MutatingWebhookConfiguration, the requests are sent to path of the server.
+func SelfNSHPMutatingWebHookRegistration(clientset *kubernetes.Clientset, configName, serverName, serverUrl, path string, caCert []byte) {
+	client := clientset.AdmissionregistrationV1beta1().MutatingWebhookConfigurations()
+	_, err := client.Get(configName, metav1.GetOptions{})
+	if err == nil {
+		if err2 := client.Delete(configName, nil); err2 != nil {
+			glog.Fatal(err2)
+		}
+	}
+	config := v1beta1.WebhookClientConfig{
+		CABundle: caCert,
+	}
+	if serverUrl != "" {
+		url := strings.TrimSuffix(serverUrl, "/") + path
+		config.URL = &url
+	} else {
+		config.Service = &v1beta1.ServiceReference{
+			Namespace: AdmissionControllerNS,
+			Name:      serverName,
+			Path:      &path,
+		}
+	}
+
+	var ft v1beta1.FailurePolicyType = v1beta1.Fail
+	webhookConfig := &v1beta1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: configName,
+		},
+		Webhooks: []v1beta1.Webhook{
+			{
+				Name: "nshp-mutate.enndata.cn",
+				NamespaceSelector: &metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						metav1.LabelSelectorRequirement{
+							Key:      "enndata.cn/ignore-admission-controller-webhook",
+							Operator: metav1.LabelSelectorOpNotIn,
+							Values:   []string{"true"},
+						},
+					},
+				},
+				FailurePolicy: &ft,
+				Rules: []v1beta1.RuleWithOperations{
+					{
+						Operations: []v1beta1.OperationType{v1beta1.Create},
+						Rule: v1beta1.Rule{
+							APIGroups:   []string{""},
+							APIVersions: []string{"v1"},
+							Resources:   []string{"pods"},
+						},
+					}},
+				ClientConfig: config,
+			},
+		},
+	}
+	if _, err := client.Create(webhookConfig); err != nil {
+		glog.Fatal(err)
+	} else {
+		glog.Infof("Self registration as MutatingWebhook %s succeeded.", configName)
+	}
+}
+
+// register the workload part of hostpathpvresource with the kube-apiserver by creating
+// MutatingWebhookConfiguration, the workload controller requests are sent to path of the server.
+func SelfHPPVRWorkloadWebHookRegistration(clientset *kubernetes.Clientset, configName, serverName, serverUrl, path string, caCert []byte) {
+	client := clientset.AdmissionregistrationV1beta1().MutatingWebhookConfigurations()
+	_, err := client.Get(configName, metav1.GetOptions{})
+	if err == nil {
+		if err2 := client.Delete(configName, nil); err2 != nil {
+			glog.Fatal(err2)
+		}
+	}
+	config := v1beta1.WebhookClientConfig{
+		CABundle: caCert,
+	}
+	if serverUrl != "" {
+		url := strings.TrimSuffix(serverUrl, "/") + path
+		config.URL = &url
+	} else {
+		config.Service = &v1beta1.ServiceReference{
+			Namespace: AdmissionControllerNS,
+			Name:      serverName,
+			Path:      &path,
+		}
+	}
+
+	var ft v1beta1.FailurePolicyType = v1beta1.Fail
+	webhookConfig := &v1beta1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: configName,
+		},
+		Webhooks: []v1beta1.Webhook{
+			{
+				Name: "hppvr-workload.enndata.cn",
+				NamespaceSelector: &metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						metav1.LabelSelectorRequirement{
+							Key:      "enndata.cn/ignore-admission-controller-webhook",
+							Operator: metav1.LabelSelectorOpNotIn,
+							Values:   []string{"true"},
+						},
+					},
+				},
+				FailurePolicy: &ft,
+				Rules: []v1beta1.RuleWithOperations{
+					{
+						Operations: []v1beta1.OperationType{v1beta1.Create, v1beta1.Update},
+						Rule: v1beta1.Rule{
+							APIGroups:   []string{"apps", "extensions"},
+							APIVersions: []string{"*"},
+							Resources:   []string{"deployments", "statefulsets", "daemonsets"},
+						},
+					},
+					{
+						Operations: []v1beta1.OperationType{v1beta1.Create},
+						Rule: v1beta1.Rule{
+							APIGroups:   []string{"batch"},
+							APIVersions: []string{"*"},
+							Resources:   []string{"jobs"},
+						},
+					}},
+				ClientConfig: config,
+			},
+		},
+	}
+	if _, err := client.Create(webhookConfig); err != nil {
+		glog.Fatal(err)
+	} else {
+		glog.Infof("Self registration as MutatingWebhook %s succeeded.", configName)
+	}
+}
+
+// register the connect check of nshostpathprivilege with the kube-apiserver by creating
+// ValidatingWebhookConfiguration, the exec, attach and portforward requests are sent to path of the server.
+func SelfNSHPConnectWebHookRegistration(clientset *kubernetes.Clientset, configName, serverName, serverUrl, path string, caCert []byte) {
+	client := clientset.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations()
+	_, err := client.Get(configName, metav1.GetOptions{})
+	if err == nil {
+		if err2 := client.Delete(configName, nil); err2 != nil {
+			glog.Fatal(err2)
+		}
+	}
+	config := v1beta1.WebhookClientConfig{
+		CABundle: caCert,
+	}
+	if serverUrl != "" {
+		url := strings.TrimSuffix(serverUrl, "/") + path
+		config.URL = &url
+	} else {
+		config.Service = &v1beta1.ServiceReference{
+			Namespace: AdmissionControllerNS,
+			Name:      serverName,
+			Path:      &path,
+		}
+	}
+
+	var ft v1beta1.FailurePolicyType = v1beta1.Fail
+	webhookConfig := &v1beta1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: configName,
+		},
+		Webhooks: []v1beta1.Webhook{
+			{
+				Name: "nshp-connect.enndata.cn",
+				NamespaceSelector: &metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						metav1.LabelSelectorRequirement{
+							Key:      "enndata.cn/ignore-admission-controller-webhook",
+							Operator: metav1.LabelSelectorOpNotIn,
+							Values:   []string{"true"},
+						},
+					},
+				},
+				FailurePolicy: &ft,
+				Rules: []v1beta1.RuleWithOperations{
+					{
+						Operations: []v1beta1.OperationType{v1beta1.Connect},
+						Rule: v1beta1.Rule{
+							APIGroups:   []string{""},
+							APIVersions: []string{"v1"},
+							Resources:   []string{"pods/exec", "pods/attach", "pods/portforward"},
+						},
+					}},
+				ClientConfig: config,
+			},
+		},
+	}
+	if _, err := client.Create(webhookConfig); err != nil {
+		glog.Fatal(err)
+	} else {
+		glog.Infof("Self registration as ValidatingWebhook %s succeeded.", configName)
+	}
+}
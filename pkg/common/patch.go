@@ -0,0 +1,48 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/mattbaird/jsonpatch"
+)
+
+// CreatePatch creates the json patch which changes the old object json to the new one
+func CreatePatch(oldObj, newObj []byte) ([]byte, error) {
+	patchOperations, err := jsonpatch.CreatePatch(oldObj, newObj)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(jsonpatch.ByPath(patchOperations))
+	var b bytes.Buffer
+	b.WriteString("[")
+	l := len(patchOperations)
+	for i, patchOperation := range patchOperations {
+		buf, err := patchOperation.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		b.Write(buf)
+		if i < l-1 {
+			b.WriteString(",")
+		}
+	}
+	b.WriteString("]")
+	return b.Bytes(), nil
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	xfs "github.com/Rhealb/csi-plugin/hostpathpv/pkg/hostpath/xfsquotamanager/common"
+	"github.com/Rhealb/extender-scheduler/pkg/algorithm"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// the actions for the pods whose hostpath pvs can not fit any node
+	diskFitNone   = "none"
+	diskFitWarn   = "warn"
+	diskFitReject = "reject"
+
+	// PodDiskFitWarningAnn records the hostpath pvs of the pod which can not fit any node
+	PodDiskFitWarningAnn = "io.enndata.hppvr/diskfit-warning"
+)
+
+// getNodeDisableDisks returns the quota disks disabled by `kubectl hostpathpv setdisable`
+func getNodeDisableDisks(node *v1.Node) map[string]bool {
+	ret := make(map[string]bool)
+	if node.Annotations == nil {
+		return ret
+	}
+	for _, disk := range strings.Split(node.Annotations[xfs.NodeDiskQuotaDisableListAnn], ",") {
+		if disk = strings.TrimSpace(disk); disk != "" {
+			ret[path.Clean(disk)] = true
+		}
+	}
+	return ret
+}
+
+// isPathOnDisk returns whether the quota directory hostPath is on the quota disk mounted at mountPath
+func isPathOnDisk(hostPath, mountPath string) bool {
+	hostPath, mountPath = path.Clean(hostPath), path.Clean(mountPath)
+	return hostPath == mountPath || strings.HasPrefix(hostPath, mountPath+"/")
+}
+
+// getNodesQuotaUsed returns the quota bytes used by the hostpath pvs on every quota directory of the nodes
+func (s *AdmissionServer) getNodesQuotaUsed() (map[string]map[string]int64, error) {
+	ret := make(map[string]map[string]int64)
+	pvs, err := s.pvInfo.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, pv := range pvs {
+		if algorithm.IsCommonHostPathPV(pv) == false {
+			continue
+		}
+		mountInfos, err := algorithm.GetHostPathPVMountInfoList(pv)
+		if err != nil {
+			return nil, fmt.Errorf("get pv %s mount info err:%v", pv.Name, err)
+		}
+		for _, info := range mountInfos {
+			if ret[info.NodeName] == nil {
+				ret[info.NodeName] = make(map[string]int64)
+			}
+			for _, mountInfo := range info.MountInfos {
+				ret[info.NodeName][path.Clean(mountInfo.HostPath)] = mountInfo.VolumeQuotaSize
+			}
+		}
+	}
+	return ret, nil
+}
+
+// getNodeMaxFreeQuota returns the largest free quota bytes of the enabled quota disks of the node
+func getNodeMaxFreeQuota(node *v1.Node, used map[string]int64) (int64, error) {
+	if node.Spec.Unschedulable {
+		return 0, nil
+	}
+	disks, err := algorithm.GetNodeDiskInfo(node)
+	if err != nil {
+		return 0, err
+	}
+	disabled := getNodeDisableDisks(node)
+	var max int64
+	for _, disk := range disks {
+		if disk.Disabled || disabled[path.Clean(disk.MountPath)] {
+			continue
+		}
+		free := disk.Allocable
+		for hostPath, size := range used {
+			if isPathOnDisk(hostPath, disk.MountPath) {
+				free -= size
+			}
+		}
+		if free > max {
+			max = free
+		}
+	}
+	return max, nil
+}
+
+// needNewQuota returns whether a new quota directory will be created for the pod using pv,
+// the keep and shared hostpath pvs reuse their quota directories once created.
+func needNewQuota(pv *v1.PersistentVolume) (bool, error) {
+	if algorithm.IsKeepHostPathPV(pv) == false && algorithm.IsSharedHostPathPV(pv) == false {
+		return true, nil
+	}
+	mountInfos, err := algorithm.GetHostPathPVMountInfoList(pv)
+	if err != nil {
+		return false, err
+	}
+	for _, info := range mountInfos {
+		if len(info.MountInfos) > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// getUnfitHostPathPVs returns the hostpath pvs of the pod whose capacity is larger than
+// the free quota of every enabled quota disk of the schedulable nodes.
+func (s *AdmissionServer) getUnfitHostPathPVs(info *podVolumeInfo) ([]string, error) {
+	capacities := make(map[string]int64)
+	for _, pv := range info.pvs {
+		if algorithm.IsCommonHostPathPV(pv) == false {
+			continue
+		}
+		if need, err := needNewQuota(pv); err != nil {
+			return nil, fmt.Errorf("get pv %s mount info err:%v", pv.Name, err)
+		} else if need == false {
+			continue
+		}
+		capacity, err := algorithm.GetHostPathPVCapacity(pv)
+		if err != nil {
+			return nil, err
+		}
+		capacities[pv.Name] = capacity
+	}
+	if len(capacities) == 0 {
+		return nil, nil
+	}
+
+	nodes, err := s.nodeLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	used, err := s.getNodesQuotaUsed()
+	if err != nil {
+		return nil, err
+	}
+	var max int64
+	for _, node := range nodes {
+		free, err := getNodeMaxFreeQuota(node, used[node.Name])
+		if err != nil {
+			glog.Errorf("get node %s disk info err:%v", node.Name, err)
+			continue
+		}
+		if free > max {
+			max = free
+		}
+	}
+	ret := []string{}
+	for _, pv := range info.pvs {
+		if capacity, exist := capacities[pv.Name]; exist && capacity > max {
+			ret = append(ret, fmt.Sprintf("%s(%d bytes)", pv.Name, capacity))
+		}
+	}
+	return ret, nil
+}
+
+// checkDiskFit rejects or warns the pod whose hostpath pvs can not fit any node
+func (s *AdmissionServer) checkDiskFit(pod *v1.Pod, info *podVolumeInfo) (reject bool, err error) {
+	unfit, err := s.getUnfitHostPathPVs(info)
+	if err != nil {
+		return false, fmt.Errorf("check disk fit of pod %s:%s err:%v", pod.Namespace, pod.Name, err)
+	}
+	if len(unfit) == 0 {
+		return false, nil
+	}
+	reason := fmt.Sprintf("hostpath pvs %s can not fit the free quota disk of any node", strings.Join(unfit, ","))
+	if s.diskFit == diskFitReject {
+		return true, fmt.Errorf("pod %s:%s %s", pod.Namespace, pod.Name, reason)
+	}
+	glog.Warningf("pod %s:%s %s", pod.Namespace, pod.Name, reason)
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[PodDiskFitWarningAnn] = reason
+	return false, nil
+}
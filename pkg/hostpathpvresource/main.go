@@ -18,9 +18,7 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/Rhealb/admission-controller/pkg/utils/metrics"
@@ -31,6 +29,7 @@ import (
 	"k8s.io/apimachinery/pkg/util/wait"
 	kube_flag "k8s.io/apiserver/pkg/util/flag"
 	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
@@ -43,6 +42,18 @@ var (
 	serverUrl           = flag.String("serverurl", "", "The server url of this controller.")
 	registConfigAuto    = flag.Bool("auto-regist-config", true, "Need regist hook config automatically")
 	hostpathPVScheduler = flag.String("scheduler-name", "enndata-scheduler", "The hostpathpv pods' scheduler")
+	healthCheckEnable   = flag.Bool("scheduler-health-check", false, "Watch the leader election locks of the custom schedulers and fall back when they are unavailable")
+	lockKind            = flag.String("scheduler-lock-kind", "endpoints", "The kind of the leader election locks of the custom schedulers, endpoints or lease, the locks are named as the schedulers")
+	lockNamespace       = flag.String("scheduler-lock-namespace", "kube-system", "The namespace of the leader election locks of the custom schedulers")
+	unavailableTime     = flag.Duration("scheduler-unavailable-threshold", 2*time.Minute, "A custom scheduler is unavailable if its lock is not renewed for the time")
+	fallbackAction      = flag.String("scheduler-fallback", "reject", "The action for the pods whose custom scheduler is unavailable, reject or default (the default scheduler with the node affinity of keep hostpath pvs)")
+	injectAffinity      = flag.Bool("inject-node-affinity", false, "Inject the required node affinity of the keep hostpath pvs into the pods so that any scheduler keeps them sticky")
+	injectResource      = flag.Bool("inject-hostpathpv-resource", false, "Inject the request and limit of the enndata.cn/hostpathpv extended resource (the quota bytes of the hostpath pvs) into the pods")
+	diskFitCheck        = flag.String("disk-fit-check", "none", "The action for the pods whose hostpath pvs can not fit the free quota disk of any node, none, warn or reject")
+	enableWorkload      = flag.Bool("enable-workload-mutate", false, "Regist the mutating web hook which sets the schedulerName of the pod templates of deployments, statefulsets, daemonsets and jobs")
+	workloadConfigName  = flag.String("workload-config-name", "hostpathpvresource-workload", "The hostpathpvresource workload mutating web hook config name.")
+	overridePolicy      = flag.String("scheduler-override", "always", "How to handle the pods which have chosen a scheduler other than the default scheduler, always, only-when-default or never-with-warning")
+	rulesFile           = flag.String("rules-file", "", "The yaml or json file of the scheduler routing rules, the pods using hostpath pvs are routed to --scheduler-name if it is not set")
 )
 
 func main() {
@@ -54,6 +65,31 @@ func main() {
 	metrics.Initialize(*metricAddress, healthCheck)
 	metrics.Register()
 
+	var rules *SchedulerRules
+	var err error
+	if *rulesFile != "" {
+		rules, err = LoadSchedulerRules(*rulesFile)
+	} else {
+		rules, err = NewDefaultSchedulerRules(*hostpathPVScheduler)
+	}
+	if err != nil {
+		glog.Fatalf("load scheduler rules err:%v", err)
+	}
+
+	if *fallbackAction != fallbackReject && *fallbackAction != fallbackDefault {
+		glog.Fatalf("scheduler-fallback should be %s or %s, not %s", fallbackReject, fallbackDefault, *fallbackAction)
+	}
+
+	if *diskFitCheck != diskFitNone && *diskFitCheck != diskFitWarn && *diskFitCheck != diskFitReject {
+		glog.Fatalf("disk-fit-check should be %s, %s or %s, not %s", diskFitNone, diskFitWarn, diskFitReject, *diskFitCheck)
+	}
+
+	switch *overridePolicy {
+	case overrideAlways, overrideOnlyWhenDefault, overrideNeverWithWarning:
+	default:
+		glog.Fatalf("scheduler-override should be %s, %s or %s, not %s", overrideAlways, overrideOnlyWhenDefault, overrideNeverWithWarning, *overridePolicy)
+	}
+
 	certs := common.InitCerts(*certsDir)
 	clientset := common.GetClient()
 	sharedInformers := informers.NewSharedInformerFactory(clientset, 0)
@@ -61,19 +97,49 @@ func main() {
 
 	pvInformer := sharedInformers.Core().V1().PersistentVolumes()
 	pvcInformer := sharedInformers.Core().V1().PersistentVolumeClaims()
+	scInformer := sharedInformers.Storage().V1().StorageClasses()
+	stsInformer := sharedInformers.Apps().V1().StatefulSets()
 	pvSynced := pvInformer.Informer().HasSynced
 	pvcSynced := pvcInformer.Informer().HasSynced
-	as := NewAdmissionServer(clientset, pvInformer.Lister(), pvcInformer.Lister(), *hostpathPVScheduler)
+	scSynced := scInformer.Informer().HasSynced
+	stsSynced := stsInformer.Informer().HasSynced
+	synced := []cache.InformerSynced{pvSynced, pvcSynced, scSynced, stsSynced}
+	// the pods are watched to find the nodes where the keep hostpath pvs are used
+	var podLister corelisters.PodLister
+	if *injectAffinity || (*healthCheckEnable && *fallbackAction == fallbackDefault) {
+		podInformer := sharedInformers.Core().V1().Pods()
+		podLister = podInformer.Lister()
+		synced = append(synced, podInformer.Informer().HasSynced)
+	}
+	var nodeLister corelisters.NodeLister
+	if *diskFitCheck != diskFitNone {
+		nodeInformer := sharedInformers.Core().V1().Nodes()
+		nodeLister = nodeInformer.Lister()
+		synced = append(synced, nodeInformer.Informer().HasSynced)
+	}
+	var health *SchedulerHealth
+	if *healthCheckEnable {
+		health, err = NewSchedulerHealth(clientset, *lockKind, *lockNamespace, rules.getSchedulerNames(), *unavailableTime, 10*time.Second)
+		if err != nil {
+			glog.Fatalf("create scheduler health check err:%v", err)
+		}
+		go health.Run(stopEverything)
+	}
+	as := NewAdmissionServer(clientset, pvInformer.Lister(), pvcInformer.Lister(), scInformer.Lister(), stsInformer.Lister(),
+		podLister, nodeLister, rules, health, *fallbackAction, *injectAffinity, *injectResource, *diskFitCheck, *overridePolicy)
 	sharedInformers.Start(stopEverything)
-	if !cache.WaitForCacheSync(wait.NeverStop, pvSynced, pvcSynced) {
-		fmt.Errorf("timed out waiting for pv or pvc caches to sync")
-		os.Exit(-1)
+	if !cache.WaitForCacheSync(wait.NeverStop, synced...) {
+		glog.Fatalf("timed out waiting for pv, pvc, storageclass, statefulset, pod or node caches to sync")
 	}
 	var sm http.ServeMux
 	sm.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		as.Serve(w, r)
 		healthCheck.UpdateLastActivity()
 	})
+	sm.HandleFunc(workloadPath, func(w http.ResponseWriter, r *http.Request) {
+		as.ServeWorkload(w, r)
+		healthCheck.UpdateLastActivity()
+	})
 	server := &http.Server{
 		Addr:      *address,
 		TLSConfig: common.ConfigTLS(clientset, certs.ServerCert, certs.ServerKey),
@@ -84,6 +150,9 @@ func main() {
 			glog.Fatalf("servername and serverurl are all empty")
 		}
 		go common.SelfPodMutatingWebHookRegistration(clientset, *webHookConfigName, *serverName, *serverUrl, certs.CaCert)
+		if *enableWorkload {
+			go common.SelfHPPVRWorkloadWebHookRegistration(clientset, *workloadConfigName, *serverName, *serverUrl, workloadPath, certs.CaCert)
+		}
 	}
 	glog.Infof("start httpserver")
 	server.ListenAndServeTLS("", "")
@@ -0,0 +1,164 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Rhealb/extender-scheduler/pkg/algorithm"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+)
+
+// nodeHostNameLabel is used instead of the metadata.name field since the apiserver
+// only accepts one value for the In operator of the node field selectors
+const nodeHostNameLabel = "kubernetes.io/hostname"
+
+// getKeepHostPathPVNodes returns the nodes where the quota directories of the keep hostpath pv exist
+// and the nodes where the pods using it are running, nil is returned if the pv is not sticky to any node.
+func (s *AdmissionServer) getKeepHostPathPVNodes(pv *v1.PersistentVolume) (map[string]bool, error) {
+	if algorithm.IsKeepHostPathPV(pv) == false {
+		return nil, nil
+	}
+	mountInfos, err := algorithm.GetHostPathPVMountInfoList(pv)
+	if err != nil {
+		return nil, err
+	}
+	var nodes map[string]bool
+	for _, info := range mountInfos {
+		if len(info.MountInfos) == 0 {
+			continue
+		}
+		if nodes == nil {
+			nodes = make(map[string]bool)
+		}
+		nodes[info.NodeName] = true
+	}
+	if s.podInfo != nil && pv.Spec.ClaimRef != nil {
+		usedNodes, err := algorithm.GetHostPathPVUsedNodeMap(pv, s.podInfo)
+		if err != nil {
+			return nil, err
+		}
+		for node := range usedNodes {
+			if nodes == nil {
+				nodes = make(map[string]bool)
+			}
+			nodes[node] = true
+		}
+	}
+	return nodes, nil
+}
+
+// intersectNodes returns the nodes in both a and b, nil means all nodes
+func intersectNodes(a, b map[string]bool) map[string]bool {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	ret := make(map[string]bool)
+	for node := range a {
+		if b[node] {
+			ret[node] = true
+		}
+	}
+	return ret
+}
+
+// getPodKeepNodes returns the nodes the pod can run on because of its keep hostpath pvs, nil means all nodes
+func (s *AdmissionServer) getPodKeepNodes(pvs []*v1.PersistentVolume) (map[string]bool, error) {
+	var ret map[string]bool
+	for _, pv := range pvs {
+		nodes, err := s.getKeepHostPathPVNodes(pv)
+		if err != nil {
+			return nil, err
+		}
+		ret = intersectNodes(ret, nodes)
+	}
+	return ret, nil
+}
+
+// injectNodeAffinity restricts the pod to nodes by adding a required node affinity
+// requirement to every node selector term of the pod (or a new term if there is none).
+func injectNodeAffinity(pod *v1.Pod, nodes map[string]bool) {
+	names := make([]string, 0, len(nodes))
+	for node := range nodes {
+		names = append(names, node)
+	}
+	sort.Strings(names)
+	requirement := v1.NodeSelectorRequirement{
+		Key:      nodeHostNameLabel,
+		Operator: v1.NodeSelectorOpIn,
+		Values:   names,
+	}
+
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &v1.Affinity{}
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil {
+		pod.Spec.Affinity.NodeAffinity = &v1.NodeAffinity{}
+	}
+	nodeAffinity := pod.Spec.Affinity.NodeAffinity
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &v1.NodeSelector{}
+	}
+	selector := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(selector.NodeSelectorTerms) == 0 {
+		selector.NodeSelectorTerms = []v1.NodeSelectorTerm{{}}
+	}
+	for i := range selector.NodeSelectorTerms {
+		term := &selector.NodeSelectorTerms[i]
+		if hasNodeSelectorRequirement(term.MatchExpressions, requirement) == false {
+			term.MatchExpressions = append(term.MatchExpressions, requirement)
+		}
+	}
+}
+
+func hasNodeSelectorRequirement(requirements []v1.NodeSelectorRequirement, requirement v1.NodeSelectorRequirement) bool {
+	for _, r := range requirements {
+		if r.Key == requirement.Key && r.Operator == requirement.Operator &&
+			fmt.Sprint(r.Values) == fmt.Sprint(requirement.Values) {
+			return true
+		}
+	}
+	return false
+}
+
+// injectKeepNodeAffinity restricts the pod to the nodes of its keep hostpath pvs so that
+// the schedulers which know nothing about hostpath pvs also keep the pvs sticky.
+func (s *AdmissionServer) injectKeepNodeAffinity(pod *v1.Pod, info *podVolumeInfo) error {
+	if pod.Spec.NodeName != "" {
+		return nil
+	}
+	nodes, err := s.getPodKeepNodes(info.pvs)
+	if err != nil {
+		return fmt.Errorf("get keep nodes of pod %s:%s err:%v", pod.Namespace, pod.Name, err)
+	}
+	if nodes == nil {
+		return nil
+	}
+	if len(nodes) == 0 {
+		// the node affinity can not be satisfied, leave it to the scheduler to report
+		glog.Warningf("keep hostpath pvs of pod %s:%s have no common node", pod.Namespace, pod.Name)
+		return nil
+	}
+	glog.V(4).Infof("pod %s:%s is restricted to nodes %v by keep hostpath pvs", pod.Namespace, pod.Name, nodes)
+	injectNodeAffinity(pod, nodes)
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Rhealb/extender-scheduler/pkg/algorithm"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const defaultStorageClassAnn = "storageclass.kubernetes.io/is-default-class"
+
+// getClaimStorageClassName returns the storage class of the claim, the default storage class
+// is returned if it is not set (the pvcs of volumeClaimTemplates may not be defaulted yet).
+func (s *AdmissionServer) getClaimStorageClassName(spec *v1.PersistentVolumeClaimSpec) (string, error) {
+	if spec.StorageClassName != nil {
+		return *spec.StorageClassName, nil
+	}
+	classes, err := s.scLister.List(labels.Everything())
+	if err != nil {
+		return "", err
+	}
+	for _, class := range classes {
+		if class.Annotations[defaultStorageClassAnn] == "true" {
+			return class.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// getStatefulSetClaimSpec returns the volumeClaimTemplate of the pvc claimName of the statefulset pod,
+// the pvc may not be in the cache yet when the pod is created.
+func (s *AdmissionServer) getStatefulSetClaimSpec(pod *v1.Pod, claimName string) (*v1.PersistentVolumeClaimSpec, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "StatefulSet" {
+		return nil, nil
+	}
+	sts, err := s.stsLister.StatefulSets(pod.Namespace).Get(owner.Name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for i := range sts.Spec.VolumeClaimTemplates {
+		template := &sts.Spec.VolumeClaimTemplates[i]
+		// the pvc of the statefulset pod is named as <template>-<pod>
+		if claimName == fmt.Sprintf("%s-%s", template.Name, pod.Name) {
+			return &template.Spec, nil
+		}
+	}
+	return nil, nil
+}
+
+// newProvisionedHostPathPV returns a pv like the ones the hostpath provisioner of class creates
+func newProvisionedHostPathPV(class *storagev1.StorageClass) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: fmt.Sprintf("<provisioned by %s>", class.Name),
+		},
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName: class.Name,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver: class.Provisioner,
+				},
+			},
+		},
+	}
+}
+
+// predictClaimPV predicts the hostpath pv which will back the unbound claim, nil is returned if it
+// will not be a hostpath pv. The claim is bound to a hostpath pv when:
+// 1) it is pre-bound to a hostpath pv by volumeName.
+// 2) its storage class is provisioned by a hostpath provisioner.
+// 3) an available hostpath pv matches its storage class and selector, this is how the static
+// pvs of the WaitForFirstConsumer storage classes are bound after the pod is scheduled.
+func (s *AdmissionServer) predictClaimPV(spec *v1.PersistentVolumeClaimSpec) (pv *v1.PersistentVolume, predicted bool, err error) {
+	if spec.VolumeName != "" {
+		pv, err := s.pvInfo.GetPersistentVolumeInfo(spec.VolumeName)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+		return pv, false, nil
+	}
+	className, err := s.getClaimStorageClassName(spec)
+	if err != nil {
+		return nil, false, err
+	}
+	if className != "" {
+		class, err := s.scLister.Get(className)
+		if err != nil && errors.IsNotFound(err) == false {
+			return nil, false, err
+		}
+		if class != nil && strings.Contains(strings.ToLower(class.Provisioner), "hostpath") {
+			return newProvisionedHostPathPV(class), true, nil
+		}
+	}
+
+	selector := labels.Everything()
+	if spec.Selector != nil {
+		if selector, err = metav1.LabelSelectorAsSelector(spec.Selector); err != nil {
+			return nil, false, err
+		}
+	}
+	pvs, err := s.pvInfo.List()
+	if err != nil {
+		return nil, false, err
+	}
+	for _, pv := range pvs {
+		if pv.Spec.ClaimRef != nil || pv.Status.Phase != v1.VolumeAvailable || pv.Spec.StorageClassName != className {
+			continue
+		}
+		if algorithm.IsCommonHostPathPV(pv) && selector.Matches(labels.Set(pv.Labels)) {
+			return pv, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// getClaimPV returns the pv of the pod volume, the pv is predicted if the pvc is not bound yet
+func (s *AdmissionServer) getClaimPV(pod *v1.Pod, podVolume v1.Volume) (pv *v1.PersistentVolume, predicted bool, err error) {
+	claimName := podVolume.PersistentVolumeClaim.ClaimName
+	pvc, err := s.pvcInfo.GetPersistentVolumeClaimInfo(pod.Namespace, claimName)
+	if err != nil && errors.IsNotFound(err) == false {
+		return nil, false, err
+	}
+	if pvc != nil && pvc.Status.Phase == v1.ClaimBound {
+		pv, err := algorithm.GetPodVolumePV(pod, podVolume, s.pvInfo, s.pvcInfo)
+		return pv, false, err
+	}
+
+	var spec *v1.PersistentVolumeClaimSpec
+	if pvc != nil {
+		spec = &pvc.Spec
+	} else if spec, err = s.getStatefulSetClaimSpec(pod, claimName); err != nil {
+		return nil, false, err
+	} else if spec == nil {
+		glog.V(4).Infof("pvc %s:%s of pod %s is not found", pod.Namespace, claimName, pod.Name)
+		return nil, false, nil
+	}
+	pv, predicted, err = s.predictClaimPV(spec)
+	if err != nil {
+		return nil, false, fmt.Errorf("predict pv of pvc %s:%s err:%v", pod.Namespace, claimName, err)
+	}
+	if pv != nil {
+		glog.V(4).Infof("pvc %s:%s of pod %s is not bound, predicted pv %s", pod.Namespace, claimName, pod.Name, pv.Name)
+	}
+	return pv, predicted, nil
+}
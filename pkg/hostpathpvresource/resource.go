@@ -0,0 +1,79 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+
+	"github.com/Rhealb/extender-scheduler/pkg/algorithm"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// getHostPathPVResource returns the quota bytes of the hostpath pvs used by the pod, the shared
+// hostpath pvs are not counted because their quota directories are not created for every pod.
+func getHostPathPVResource(pvs []*v1.PersistentVolume) (int64, error) {
+	var total int64
+	for _, pv := range pvs {
+		if algorithm.IsCommonHostPathPV(pv) == false || algorithm.IsSharedHostPathPV(pv) {
+			continue
+		}
+		capacity, err := algorithm.GetHostPathPVCapacity(pv)
+		if err != nil {
+			return 0, err
+		}
+		total += capacity
+	}
+	return total, nil
+}
+
+// injectHostPathPVResource adds the request and limit of hostPathPVResourceName to the first container
+// of the pod, the extended resource can not be overcommitted so the request equals the limit.
+// The pod is not changed if any container has set the resource.
+func injectHostPathPVResource(pod *v1.Pod, info *podVolumeInfo) error {
+	if len(pod.Spec.Containers) == 0 {
+		return nil
+	}
+	for _, container := range pod.Spec.Containers {
+		if _, exist := container.Resources.Limits[hostPathPVResourceName]; exist {
+			return nil
+		}
+		if _, exist := container.Resources.Requests[hostPathPVResourceName]; exist {
+			return nil
+		}
+	}
+	total, err := getHostPathPVResource(info.pvs)
+	if err != nil {
+		return fmt.Errorf("get hostpath pv resource of pod %s:%s err:%v", pod.Namespace, pod.Name, err)
+	}
+	if total == 0 {
+		return nil
+	}
+	quantity := *resource.NewQuantity(total, resource.BinarySI)
+	resources := &pod.Spec.Containers[0].Resources
+	if resources.Limits == nil {
+		resources.Limits = make(v1.ResourceList)
+	}
+	if resources.Requests == nil {
+		resources.Requests = make(v1.ResourceList)
+	}
+	resources.Limits[hostPathPVResourceName] = quantity
+	resources.Requests[hostPathPVResourceName] = quantity
+	glog.V(4).Infof("pod %s:%s requests %s %s", pod.Namespace, pod.Name, quantity.String(), hostPathPVResourceName)
+	return nil
+}
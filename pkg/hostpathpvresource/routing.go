@@ -0,0 +1,108 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// the policies for the pods which have chosen a scheduler other than the default scheduler
+	// overrideAlways sets the scheduler of the pod to the routed one
+	overrideAlways = "always"
+	// overrideOnlyWhenDefault keeps the scheduler chosen by the user
+	overrideOnlyWhenDefault = "only-when-default"
+	// overrideNeverWithWarning never changes the scheduler and records the routed one as a warning
+	overrideNeverWithWarning = "never-with-warning"
+
+	// PodSchedulerRuleAnn is the rule which routed the pod
+	PodSchedulerRuleAnn = "io.enndata.hppvr/scheduler-rule"
+	// PodSchedulerPVsAnn lists the pvs which triggered the rule, separated by ','
+	PodSchedulerPVsAnn = "io.enndata.hppvr/scheduler-pvs"
+	// PodSchedulerReasonAnn is why the scheduler of the pod is or is not changed
+	PodSchedulerReasonAnn = "io.enndata.hppvr/scheduler-reason"
+	// PodSchedulerWarningAnn is set when the pod keeps a scheduler different from the routed one
+	PodSchedulerWarningAnn = "io.enndata.hppvr/scheduler-warning"
+)
+
+// routingDecision is the scheduler decision of a pod
+type routingDecision struct {
+	// scheduler is the routed scheduler, empty if no rule routes the pod
+	scheduler string
+	rule      string
+	pvs       []string
+	// override is whether the scheduler of the pod should be set to scheduler
+	override bool
+	reason   string
+	warning  string
+}
+
+func isDefaultScheduler(scheduler string) bool {
+	return scheduler == "" || scheduler == v1.DefaultSchedulerName
+}
+
+// route decides the scheduler of the pod by the rules and the override policy
+func (s *AdmissionServer) route(pod *v1.Pod, info *podVolumeInfo) routingDecision {
+	scheduler, ruleName, pvs := s.rules.match(pod, info)
+	d := routingDecision{scheduler: scheduler, rule: ruleName, pvs: pvs}
+	if ruleName == "" {
+		d.rule = "defaultScheduler"
+	}
+	current := pod.Spec.SchedulerName
+	switch {
+	case scheduler == "":
+		return d
+	case scheduler == current:
+		d.reason = fmt.Sprintf("scheduler %s is already used", scheduler)
+	case isDefaultScheduler(current) || s.override == overrideAlways:
+		d.override = true
+		d.reason = fmt.Sprintf("routed to %s by rule %s", scheduler, d.rule)
+	case s.override == overrideOnlyWhenDefault:
+		d.reason = fmt.Sprintf("scheduler %s chosen by the user is kept, rule %s routes to %s", current, d.rule, scheduler)
+	}
+	if s.override == overrideNeverWithWarning && scheduler != current && !isDefaultScheduler(current) {
+		d.override = false
+		d.reason = fmt.Sprintf("scheduler %s chosen by the user is not changed, rule %s routes to %s", current, d.rule, scheduler)
+		d.warning = fmt.Sprintf("pod should use scheduler %s by rule %s", scheduler, d.rule)
+		if len(d.pvs) > 0 {
+			d.warning = fmt.Sprintf("%s for pvs %s", d.warning, strings.Join(d.pvs, ","))
+		}
+	}
+	return d
+}
+
+// annotate records the decision on the pod
+func (d routingDecision) annotate(pod *v1.Pod) {
+	if d.scheduler == "" {
+		return
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[PodSchedulerRuleAnn] = d.rule
+	pod.Annotations[PodSchedulerReasonAnn] = d.reason
+	if len(d.pvs) > 0 {
+		pod.Annotations[PodSchedulerPVsAnn] = strings.Join(d.pvs, ",")
+	}
+	if d.warning != "" {
+		pod.Annotations[PodSchedulerWarningAnn] = d.warning
+		glog.Warningf("pod %s:%s %s: %s", pod.Namespace, pod.Name, d.warning, d.reason)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/Rhealb/extender-scheduler/pkg/algorithm"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// the pv types can be matched by the rules
+const (
+	// pvTypeHostPath matches all the hostpath pvs, both hostPath and csi hostpath
+	pvTypeHostPath = "hostpath"
+	// pvTypeCSIHostPath matches the csi hostpath pvs only
+	pvTypeCSIHostPath = "csihostpath"
+	// pvTypeKeep matches the hostpath pvs whose mount policy is keep
+	pvTypeKeep = "keep"
+	// pvTypeShared matches the hostpath pvs which are shared by the pods
+	pvTypeShared = "shared"
+)
+
+var pvTypeMatchers = map[string]func(pv *v1.PersistentVolume) bool{
+	pvTypeHostPath:    algorithm.IsCommonHostPathPV,
+	pvTypeCSIHostPath: algorithm.IsCSIHostPathPV,
+	pvTypeKeep:        algorithm.IsKeepHostPathPV,
+	pvTypeShared:      algorithm.IsSharedHostPathPV,
+}
+
+// SchedulerRule routes the pods matching all its conditions to SchedulerName,
+// an empty condition matches all pods.
+type SchedulerRule struct {
+	Name          string `json:"name"`
+	Priority      int    `json:"priority"`
+	SchedulerName string `json:"schedulerName"`
+	// PVTypes matches the pods using a pv of any of the types
+	PVTypes []string `json:"pvTypes,omitempty"`
+	// StorageClasses matches the pods using a pvc of any of the storage classes
+	StorageClasses []string `json:"storageClasses,omitempty"`
+	// Namespaces matches the pods of any of the namespaces
+	Namespaces []string `json:"namespaces,omitempty"`
+	// PodSelector matches the labels of the pods
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+
+	selector labels.Selector
+}
+
+// SchedulerRules is the rules table, the rule of the highest priority matching the pod is used
+// and DefaultScheduler is used if no rule matches, the pod is not changed if it is empty.
+type SchedulerRules struct {
+	DefaultScheduler string          `json:"defaultScheduler,omitempty"`
+	Rules            []SchedulerRule `json:"rules"`
+}
+
+// podVolumeInfo is what the rules know about the volumes of a pod
+type podVolumeInfo struct {
+	pvs []*v1.PersistentVolume
+	// predictedPVs are the pvs predicted to back the pvcs which are not bound yet
+	predictedPVs   []*v1.PersistentVolume
+	storageClasses map[string]bool
+}
+
+// allPVs returns both the pvs and the predicted pvs
+func (info *podVolumeInfo) allPVs() []*v1.PersistentVolume {
+	pvs := make([]*v1.PersistentVolume, 0, len(info.pvs)+len(info.predictedPVs))
+	pvs = append(pvs, info.pvs...)
+	return append(pvs, info.predictedPVs...)
+}
+
+// NewDefaultSchedulerRules returns the rules which route the pods using hostpath pvs to scheduler
+func NewDefaultSchedulerRules(scheduler string) (*SchedulerRules, error) {
+	rules := &SchedulerRules{
+		Rules: []SchedulerRule{
+			{
+				Name:          "hostpathpv",
+				SchedulerName: scheduler,
+				PVTypes:       []string{pvTypeHostPath},
+			},
+		},
+	}
+	return rules, rules.compile()
+}
+
+// LoadSchedulerRules reads the rules from the yaml or json file
+func LoadSchedulerRules(file string) (*SchedulerRules, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read rules file %s err:%v", file, err)
+	}
+	rules := &SchedulerRules{}
+	if err := yaml.Unmarshal(buf, rules); err != nil {
+		return nil, fmt.Errorf("parse rules file %s err:%v", file, err)
+	}
+	if err := rules.compile(); err != nil {
+		return nil, fmt.Errorf("rules file %s: %v", file, err)
+	}
+	return rules, nil
+}
+
+func (r *SchedulerRules) compile() error {
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if rule.SchedulerName == "" {
+			return fmt.Errorf("rule %q has no schedulerName", rule.Name)
+		}
+		for _, pvType := range rule.PVTypes {
+			if _, exist := pvTypeMatchers[pvType]; exist == false {
+				return fmt.Errorf("rule %q has unknown pv type %q", rule.Name, pvType)
+			}
+		}
+		rule.selector = labels.Everything()
+		if rule.PodSelector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(rule.PodSelector)
+			if err != nil {
+				return fmt.Errorf("rule %q has invalid podSelector: %v", rule.Name, err)
+			}
+			rule.selector = selector
+		}
+	}
+	sort.SliceStable(r.Rules, func(i, j int) bool {
+		return r.Rules[i].Priority > r.Rules[j].Priority
+	})
+	return nil
+}
+
+func containsStr(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *SchedulerRule) matchPVTypes(info *podVolumeInfo) bool {
+	if len(rule.PVTypes) == 0 {
+		return true
+	}
+	for _, pv := range info.allPVs() {
+		for _, pvType := range rule.PVTypes {
+			if pvTypeMatchers[pvType](pv) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (rule *SchedulerRule) matchStorageClasses(info *podVolumeInfo) bool {
+	if len(rule.StorageClasses) == 0 {
+		return true
+	}
+	for _, sc := range rule.StorageClasses {
+		if info.storageClasses[sc] {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *SchedulerRule) match(pod *v1.Pod, info *podVolumeInfo) bool {
+	if len(rule.Namespaces) > 0 && containsStr(rule.Namespaces, pod.Namespace) == false {
+		return false
+	}
+	if rule.selector.Matches(labels.Set(pod.Labels)) == false {
+		return false
+	}
+	return rule.matchPVTypes(info) && rule.matchStorageClasses(info)
+}
+
+// getTriggerPVs returns the pvs matching the pv types or the storage classes of the rule
+func (rule *SchedulerRule) getTriggerPVs(info *podVolumeInfo) []string {
+	pvs := []string{}
+	for _, pv := range info.allPVs() {
+		matched := containsStr(rule.StorageClasses, pv.Spec.StorageClassName)
+		for _, pvType := range rule.PVTypes {
+			matched = matched || pvTypeMatchers[pvType](pv)
+		}
+		if matched {
+			pvs = append(pvs, pv.Name)
+		}
+	}
+	return pvs
+}
+
+// getSchedulerNames returns the custom schedulers the pods may be routed to
+func (r *SchedulerRules) getSchedulerNames() []string {
+	names := []string{}
+	seen := map[string]bool{v1.DefaultSchedulerName: true, "": true}
+	for _, rule := range r.Rules {
+		if seen[rule.SchedulerName] == false {
+			seen[rule.SchedulerName] = true
+			names = append(names, rule.SchedulerName)
+		}
+	}
+	if seen[r.DefaultScheduler] == false {
+		names = append(names, r.DefaultScheduler)
+	}
+	return names
+}
+
+// match returns the scheduler of the pod, the name of the matched rule and the pvs which triggered it,
+// the rule name is empty if the default scheduler is used.
+func (r *SchedulerRules) match(pod *v1.Pod, info *podVolumeInfo) (scheduler, ruleName string, pvs []string) {
+	for i := range r.Rules {
+		if r.Rules[i].match(pod, info) {
+			return r.Rules[i].SchedulerName, r.Rules[i].Name, r.Rules[i].getTriggerPVs(info)
+		}
+	}
+	return r.DefaultScheduler, "", nil
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Rhealb/admission-controller/pkg/utils/metrics"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// the lock kinds of the leader election of the schedulers
+	lockKindEndpoints = "endpoints"
+	lockKindLease     = "lease"
+
+	// leaderAnnotationKey is the annotation of the endpoints lock which holds the leader election record
+	leaderAnnotationKey = "control-plane.alpha.kubernetes.io/leader"
+
+	// the actions for the pods whose scheduler is unavailable
+	fallbackReject  = "reject"
+	fallbackDefault = "default"
+
+	// PodSchedulerFallbackAnn records why the pod is routed to the default scheduler
+	PodSchedulerFallbackAnn = "io.enndata.hppvr/scheduler-fallback"
+)
+
+// leaderElectionRecord is the part of the leader election record of the endpoints lock used here
+type leaderElectionRecord struct {
+	HolderIdentity       string      `json:"holderIdentity"`
+	LeaseDurationSeconds int         `json:"leaseDurationSeconds"`
+	RenewTime            metav1.Time `json:"renewTime"`
+}
+
+// SchedulerHealth watches the leader election locks of the schedulers, a scheduler is
+// healthy when its leader keeps renewing the lock.
+type SchedulerHealth struct {
+	client        *kubernetes.Clientset
+	lockKind      string
+	lockNamespace string
+	schedulers    []string
+	threshold     time.Duration
+	interval      time.Duration
+
+	mu          sync.Mutex
+	lastHealthy map[string]time.Time
+}
+
+// NewSchedulerHealth constructs new SchedulerHealth, the lock of every scheduler is named as the scheduler
+func NewSchedulerHealth(client *kubernetes.Clientset, lockKind, lockNamespace string, schedulers []string,
+	threshold, interval time.Duration) (*SchedulerHealth, error) {
+	if lockKind != lockKindEndpoints && lockKind != lockKindLease {
+		return nil, fmt.Errorf("unknown scheduler lock kind %s", lockKind)
+	}
+	h := &SchedulerHealth{
+		client:        client,
+		lockKind:      lockKind,
+		lockNamespace: lockNamespace,
+		schedulers:    schedulers,
+		threshold:     threshold,
+		interval:      interval,
+		lastHealthy:   make(map[string]time.Time),
+	}
+	// the schedulers are treated as healthy at startup until they are checked
+	now := time.Now()
+	for _, scheduler := range schedulers {
+		h.lastHealthy[scheduler] = now
+	}
+	return h, nil
+}
+
+// Run checks the schedulers every interval until stopCh is closed
+func (h *SchedulerHealth) Run(stopCh <-chan struct{}) {
+	glog.Infof("SchedulerHealth started, schedulers:%v, lock:%s %s", h.schedulers, h.lockKind, h.lockNamespace)
+	wait.Until(h.check, h.interval, stopCh)
+}
+
+func (h *SchedulerHealth) check() {
+	now := time.Now()
+	for _, scheduler := range h.schedulers {
+		renewTime, leaseDuration, err := h.getLockRenewTime(scheduler)
+		healthy := err == nil && renewTime.Add(leaseDuration).After(now)
+		if err != nil {
+			glog.Errorf("SchedulerHealth get lock of scheduler %s err:%v", scheduler, err)
+		}
+		h.mu.Lock()
+		if healthy {
+			h.lastHealthy[scheduler] = now
+		}
+		lastHealthy := h.lastHealthy[scheduler]
+		h.mu.Unlock()
+		metrics.SetSchedulerAvailable(scheduler, now.Sub(lastHealthy) <= h.threshold)
+		if healthy == false {
+			glog.Warningf("SchedulerHealth scheduler %s is not healthy since %s", scheduler, lastHealthy.Format(time.RFC3339))
+		}
+	}
+}
+
+func (h *SchedulerHealth) getLockRenewTime(scheduler string) (time.Time, time.Duration, error) {
+	if h.lockKind == lockKindLease {
+		lease, err := h.client.CoordinationV1beta1().Leases(h.lockNamespace).Get(scheduler, metav1.GetOptions{})
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+			return time.Time{}, 0, fmt.Errorf("lease %s:%s has not been renewed", h.lockNamespace, scheduler)
+		}
+		return lease.Spec.RenewTime.Time, time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second, nil
+	}
+	ep, err := h.client.CoreV1().Endpoints(h.lockNamespace).Get(scheduler, metav1.GetOptions{})
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if ep.Annotations == nil || ep.Annotations[leaderAnnotationKey] == "" {
+		return time.Time{}, 0, fmt.Errorf("endpoints %s:%s has no leader election record", h.lockNamespace, scheduler)
+	}
+	record := leaderElectionRecord{}
+	if err := json.Unmarshal([]byte(ep.Annotations[leaderAnnotationKey]), &record); err != nil {
+		return time.Time{}, 0, fmt.Errorf("parse leader election record of endpoints %s:%s err:%v", h.lockNamespace, scheduler, err)
+	}
+	return record.RenewTime.Time, time.Duration(record.LeaseDurationSeconds) * time.Second, nil
+}
+
+// UnavailableSince returns the last time the scheduler was healthy and whether it
+// has been unavailable longer than the threshold, the schedulers not watched are always available.
+func (h *SchedulerHealth) UnavailableSince(scheduler string) (time.Time, bool) {
+	if h == nil {
+		return time.Time{}, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	lastHealthy, exist := h.lastHealthy[scheduler]
+	if exist == false {
+		return time.Time{}, false
+	}
+	return lastHealthy, time.Since(lastHealthy) > h.threshold
+}
+
+// fallbackScheduler handles the pod routed to the unavailable scheduler, it is rejected or routed to
+// the default scheduler with the node affinity of its keep hostpath pvs. nil is returned if the pod is changed.
+func (s *AdmissionServer) fallbackScheduler(pod *v1.Pod, info *podVolumeInfo, scheduler string, since time.Time) *v1beta1.AdmissionResponse {
+	metrics.OnSchedulerFallback(scheduler, s.fallback)
+	reason := fmt.Sprintf("scheduler %s is unavailable since %s", scheduler, since.Format(time.RFC3339))
+	if s.fallback == fallbackReject {
+		return toAdmissionResponse(fmt.Errorf("%s, please retry later", reason), http.StatusServiceUnavailable)
+	}
+	if err := s.injectKeepNodeAffinity(pod, info); err != nil {
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	}
+	pod.Spec.SchedulerName = v1.DefaultSchedulerName
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[PodSchedulerFallbackAnn] = reason
+	glog.Warningf("pod %s:%s is routed to %s: %s", pod.Namespace, pod.Name, v1.DefaultSchedulerName, reason)
+	return nil
+}
@@ -16,63 +16,107 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"sort"
 
+	"github.com/Rhealb/admission-controller/pkg/common"
 	"github.com/Rhealb/admission-controller/pkg/utils/metrics"
 	"github.com/Rhealb/extender-scheduler/pkg/algorithm"
 
 	"github.com/golang/glog"
-	"github.com/mattbaird/jsonpatch"
 	"k8s.io/api/admission/v1beta1"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
 	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
 )
 
 const (
-	hostPathPVResourceName = "enndata.cn/hostpathpv"
+	// hostPathPVResourceName is the extended resource of the quota bytes of the hostpath pvs
+	hostPathPVResourceName v1.ResourceName = "enndata.cn/hostpathpv"
 )
 
 type AdmissionServer struct {
 	client    *kubernetes.Clientset
 	pvInfo    *algorithm.CachedPersistentVolumeInfo
 	pvcInfo   *algorithm.CachedPersistentVolumeClaimInfo
-	scheduler string
+	scLister  storagelisters.StorageClassLister
+	stsLister appslisters.StatefulSetLister
+	// podInfo is nil if the pods are not watched
+	podInfo        algorithm.PodInfo
+	nodeLister     corelisters.NodeLister
+	rules          *SchedulerRules
+	health         *SchedulerHealth
+	fallback       string
+	injectAffinity bool
+	injectResource bool
+	diskFit        string
+	override       string
 }
 
 // NewAdmissionServer constructs new AdmissionServer
 func NewAdmissionServer(client *kubernetes.Clientset, pvLister corelisters.PersistentVolumeLister,
-	pvcLister corelisters.PersistentVolumeClaimLister, scheduler string) *AdmissionServer {
-	return &AdmissionServer{
-		client:    client,
-		pvInfo:    &algorithm.CachedPersistentVolumeInfo{PersistentVolumeLister: pvLister},
-		pvcInfo:   &algorithm.CachedPersistentVolumeClaimInfo{PersistentVolumeClaimLister: pvcLister},
-		scheduler: scheduler,
+	pvcLister corelisters.PersistentVolumeClaimLister, scLister storagelisters.StorageClassLister,
+	stsLister appslisters.StatefulSetLister, podLister corelisters.PodLister, nodeLister corelisters.NodeLister,
+	rules *SchedulerRules, health *SchedulerHealth, fallback string, injectAffinity, injectResource bool,
+	diskFit, override string) *AdmissionServer {
+	s := &AdmissionServer{
+		client:         client,
+		pvInfo:         &algorithm.CachedPersistentVolumeInfo{PersistentVolumeLister: pvLister},
+		pvcInfo:        &algorithm.CachedPersistentVolumeClaimInfo{PersistentVolumeClaimLister: pvcLister},
+		scLister:       scLister,
+		stsLister:      stsLister,
+		nodeLister:     nodeLister,
+		rules:          rules,
+		health:         health,
+		fallback:       fallback,
+		injectAffinity: injectAffinity,
+		injectResource: injectResource,
+		diskFit:        diskFit,
+		override:       override,
 	}
+	if podLister != nil {
+		s.podInfo = &algorithm.CachedPodInfo{PodLister: podLister}
+	}
+	return s
 }
 
-func (s *AdmissionServer) isPodUsedHostPathPV(pod *v1.Pod) (bool, error) {
+// getPodVolumeInfo returns the pvs and the storage classes of the pvcs used by the pod,
+// the pvs of the pvcs not bound yet are predicted.
+func (s *AdmissionServer) getPodVolumeInfo(pod *v1.Pod) (*podVolumeInfo, error) {
+	info := &podVolumeInfo{
+		pvs:            []*v1.PersistentVolume{},
+		storageClasses: make(map[string]bool),
+	}
 	for _, podVolume := range pod.Spec.Volumes {
-		pv, err := algorithm.GetPodVolumePV(pod, podVolume, s.pvInfo, s.pvcInfo)
+		if podVolume.PersistentVolumeClaim == nil {
+			continue
+		}
+		pv, predicted, err := s.getClaimPV(pod, podVolume)
 		if err != nil {
-			return false, fmt.Errorf("get pod %s:%s volume:%v err:%v", pod.Namespace, pod.Name, podVolume, err)
+			return nil, fmt.Errorf("get pod %s:%s volume:%v err:%v", pod.Namespace, pod.Name, podVolume, err)
 		}
 		if pv == nil {
 			continue
 		}
-		if algorithm.IsCommonHostPathPV(pv) {
-			glog.Infof("pod %s:%s use hostpathpv %s", pod.Namespace, pod.Name, pv.Name)
-			return true, nil
+		if predicted {
+			info.predictedPVs = append(info.predictedPVs, pv)
+		} else {
+			if algorithm.IsCommonHostPathPV(pv) {
+				glog.Infof("pod %s:%s use hostpathpv %s", pod.Namespace, pod.Name, pv.Name)
+			}
+			info.pvs = append(info.pvs, pv)
+		}
+		if pv.Spec.StorageClassName != "" {
+			info.storageClasses[pv.Spec.StorageClassName] = true
 		}
 	}
-	return false, nil
+	return info, nil
 }
 
 func toAdmissionResponse(err error, code int32) *v1beta1.AdmissionResponse {
@@ -110,14 +154,46 @@ func (s *AdmissionServer) admit(ar v1beta1.AdmissionReview) *v1beta1.AdmissionRe
 	newPod.Namespace = ar.Request.Namespace
 	newPod.Name = ar.Request.Name
 
-	if used, err := s.isPodUsedHostPathPV(newPod); err != nil {
+	info, err := s.getPodVolumeInfo(newPod)
+	if err != nil {
 		return toAdmissionResponse(err, http.StatusInternalServerError)
-	} else if used {
-		pod.Spec.SchedulerName = s.scheduler
+	}
+	if s.diskFit != diskFitNone && ar.Request.Operation == v1beta1.Create {
+		if reject, err := s.checkDiskFit(&pod, info); reject {
+			return toAdmissionResponse(err, http.StatusForbidden)
+		} else if err != nil {
+			return toAdmissionResponse(err, http.StatusInternalServerError)
+		}
+	}
+	decision := s.route(newPod, info)
+	// the routing decision is made when the pod is created, the updates do not record it again
+	if ar.Request.Operation == v1beta1.Create {
+		decision.annotate(&pod)
+	}
+	if decision.override {
+		glog.V(4).Infof("pod %s:%s is routed to scheduler %s by rule %q", newPod.Namespace, newPod.Name, decision.scheduler, decision.rule)
+		pod.Spec.SchedulerName = decision.scheduler
+		// the scheduler of a pod can not be changed after it is created, so only the new pods fall back
+		if since, unavailable := s.health.UnavailableSince(decision.scheduler); unavailable && ar.Request.Operation == v1beta1.Create {
+			if response := s.fallbackScheduler(&pod, info, decision.scheduler, since); response != nil {
+				return response
+			}
+		}
+	}
+	// the node affinity and the resources of a pod can not be changed after it is created
+	if s.injectAffinity && ar.Request.Operation == v1beta1.Create {
+		if err := s.injectKeepNodeAffinity(&pod, info); err != nil {
+			return toAdmissionResponse(err, http.StatusInternalServerError)
+		}
+	}
+	if s.injectResource && ar.Request.Operation == v1beta1.Create {
+		if err := injectHostPathPVResource(&pod, info); err != nil {
+			return toAdmissionResponse(err, http.StatusInternalServerError)
+		}
 	}
 	if newPodJson, err := json.Marshal(&pod); err != nil {
 		return toAdmissionResponse(err, http.StatusInternalServerError)
-	} else if patch, errPath := createPatch(ar.Request.Object.Raw, newPodJson); errPath != nil {
+	} else if patch, errPath := common.CreatePatch(ar.Request.Object.Raw, newPodJson); errPath != nil {
 		return toAdmissionResponse(errPath, http.StatusInternalServerError)
 	} else {
 		var patchType = v1beta1.PatchTypeJSONPatch
@@ -131,6 +207,15 @@ func (s *AdmissionServer) admit(ar v1beta1.AdmissionReview) *v1beta1.AdmissionRe
 
 // Serve is a handler function of AdmissionServer
 func (s *AdmissionServer) Serve(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, s.admit)
+}
+
+// ServeWorkload is a handler function of AdmissionServer for the workload controllers
+func (s *AdmissionServer) ServeWorkload(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, s.admitWorkload)
+}
+
+func serve(w http.ResponseWriter, r *http.Request, admit func(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse) {
 	timer := metrics.NewAdmissionLatency()
 
 	var body []byte
@@ -158,7 +243,7 @@ func (s *AdmissionServer) Serve(w http.ResponseWriter, r *http.Request) {
 		timer.Observe(metrics.Error, metrics.Unknown)
 		return
 	}
-	reviewResponse := s.admit(ar)
+	reviewResponse := admit(ar)
 	response := v1beta1.AdmissionReview{
 		Response: reviewResponse,
 	}
@@ -178,26 +263,3 @@ func (s *AdmissionServer) Serve(w http.ResponseWriter, r *http.Request) {
 
 	timer.Observe(metrics.Applied, metrics.Pod)
 }
-
-func createPatch(oldPod, newPod []byte) ([]byte, error) {
-	patchOperations, err := jsonpatch.CreatePatch(oldPod, newPod)
-	if err != nil {
-		return nil, err
-	}
-	sort.Sort(jsonpatch.ByPath(patchOperations))
-	var b bytes.Buffer
-	b.WriteString("[")
-	l := len(patchOperations)
-	for i, patchOperation := range patchOperations {
-		buf, err := patchOperation.MarshalJSON()
-		if err != nil {
-			return nil, err
-		}
-		b.Write(buf)
-		if i < l-1 {
-			b.WriteString(",")
-		}
-	}
-	b.WriteString("]")
-	return b.Bytes(), nil
-}
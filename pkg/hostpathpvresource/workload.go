@@ -0,0 +1,148 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Rhealb/admission-controller/pkg/common"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const workloadPath = "/workload"
+
+// workloadResources are the workload controllers whose pod template schedulerName is set, the pod
+// template is the same in all versions of a group so the objects are decoded by the newest one.
+var workloadResources = map[string]map[string]bool{
+	"apps":       {"deployments": true, "statefulsets": true, "daemonsets": true},
+	"extensions": {"deployments": true, "daemonsets": true},
+	"batch":      {"jobs": true},
+}
+
+// workload is the part of the workload controllers used here, all of them have spec.template
+type workload struct {
+	Spec struct {
+		Template             v1.PodTemplateSpec         `json:"template"`
+		VolumeClaimTemplates []v1.PersistentVolumeClaim `json:"volumeClaimTemplates,omitempty"`
+	} `json:"spec"`
+}
+
+func isWorkloadResource(resource metav1.GroupVersionResource) bool {
+	return workloadResources[resource.Group][resource.Resource]
+}
+
+// getWorkloadVolumeInfo returns the volume info of the pods of the workload, the pvs of the
+// volumeClaimTemplates of the statefulset are predicted.
+func (s *AdmissionServer) getWorkloadVolumeInfo(pod *v1.Pod, claimTemplates []v1.PersistentVolumeClaim) (*podVolumeInfo, error) {
+	info, err := s.getPodVolumeInfo(pod)
+	if err != nil {
+		return nil, err
+	}
+	for i := range claimTemplates {
+		pv, _, err := s.predictClaimPV(&claimTemplates[i].Spec)
+		if err != nil {
+			return nil, fmt.Errorf("predict pv of volumeClaimTemplate %s err:%v", claimTemplates[i].Name, err)
+		}
+		if pv == nil {
+			continue
+		}
+		info.predictedPVs = append(info.predictedPVs, pv)
+		if pv.Spec.StorageClassName != "" {
+			info.storageClasses[pv.Spec.StorageClassName] = true
+		}
+	}
+	return info, nil
+}
+
+// setTemplateSchedulerName sets spec.template.spec.schedulerName of the workload object raw,
+// the object is changed as a map so that the fields unknown to the typed objects are kept.
+func setTemplateSchedulerName(raw []byte, scheduler string) ([]byte, error) {
+	obj := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	templateSpec := obj
+	for _, field := range []string{"spec", "template", "spec"} {
+		next, ok := templateSpec[field].(map[string]interface{})
+		if ok == false {
+			return nil, fmt.Errorf("%s of the workload is not an object", field)
+		}
+		templateSpec = next
+	}
+	templateSpec["schedulerName"] = scheduler
+	return json.Marshal(obj)
+}
+
+// admitWorkload sets the schedulerName of the pod template of the workload controller the same as
+// the pods created by it, so that the template and its pods agree. The pod hook stays the fallback.
+func (s *AdmissionServer) admitWorkload(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+	if ar.Request == nil || isWorkloadResource(ar.Request.Resource) == false {
+		glog.Errorf("expect resource to be workload controllers")
+		return allowAdmissionResponse()
+	}
+	if ar.Request.Operation != v1beta1.Create && ar.Request.Operation != v1beta1.Update {
+		glog.Errorf("unexpect operation %s", ar.Request.Operation)
+		return allowAdmissionResponse()
+	}
+	// the pod template of a job can not be changed after it is created
+	if ar.Request.Resource.Resource == "jobs" && ar.Request.Operation != v1beta1.Create {
+		return allowAdmissionResponse()
+	}
+
+	obj := workload{}
+	if err := json.Unmarshal(ar.Request.Object.Raw, &obj); err != nil {
+		glog.Error(err)
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	}
+	pod := &v1.Pod{
+		ObjectMeta: obj.Spec.Template.ObjectMeta,
+		Spec:       obj.Spec.Template.Spec,
+	}
+	pod.Namespace = ar.Request.Namespace
+	var claimTemplates []v1.PersistentVolumeClaim
+	if ar.Request.Resource.Resource == "statefulsets" {
+		claimTemplates = obj.Spec.VolumeClaimTemplates
+	}
+	info, err := s.getWorkloadVolumeInfo(pod, claimTemplates)
+	if err != nil {
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	}
+	decision := s.route(pod, info)
+	if decision.override == false {
+		return allowAdmissionResponse()
+	}
+	glog.V(4).Infof("%s %s:%s is routed to scheduler %s by rule %q", ar.Request.Resource.Resource,
+		ar.Request.Namespace, ar.Request.Name, decision.scheduler, decision.rule)
+
+	if newObj, err := setTemplateSchedulerName(ar.Request.Object.Raw, decision.scheduler); err != nil {
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	} else if patch, errPath := common.CreatePatch(ar.Request.Object.Raw, newObj); errPath != nil {
+		return toAdmissionResponse(errPath, http.StatusInternalServerError)
+	} else {
+		var patchType = v1beta1.PatchTypeJSONPatch
+		return &v1beta1.AdmissionResponse{
+			Allowed:   true,
+			PatchType: &patchType,
+			Patch:     patch,
+		}
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"sort"
+	"strconv"
+
+	xfs "github.com/Rhealb/csi-plugin/hostpathpv/pkg/hostpath/xfsquotamanager/common"
+	"github.com/Rhealb/extender-scheduler/pkg/algorithm"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// the volume attributes of the csi hostpath driver
+const (
+	attributeKeep             = "keep"
+	attributeForOnePod        = "foronepod"
+	attributeCapacity         = "capacity"
+	attributeMountTimeout     = "mounttimeout"
+	attributeTimeoutDeletePod = "timeoutdeletepod"
+
+	nodeHostNameLabel = "kubernetes.io/hostname"
+)
+
+// annotationAttributes maps the hostpath pv annotations copied as they are to the volume attributes
+var annotationAttributes = map[string]string{
+	xfs.PVHostPathCapacityAnn:      attributeCapacity,
+	xfs.PVHostPathMountTimeoutAnn:  attributeMountTimeout,
+	xfs.PVHostPathTimeoutDelPodAnn: attributeTimeoutDeletePod,
+}
+
+// getVolumeAttributes translates the annotations of the hostpath pv to the volume attributes,
+// keep and foronepod are always set so that the csi pv does not depend on the driver defaults.
+func getVolumeAttributes(pv *v1.PersistentVolume) map[string]string {
+	attributes := map[string]string{
+		attributeKeep:      strconv.FormatBool(algorithm.IsKeepHostPathPV(pv)),
+		attributeForOnePod: strconv.FormatBool(algorithm.IsSharedHostPathPV(pv) == false),
+	}
+	for ann, attribute := range annotationAttributes {
+		if value := pv.Annotations[ann]; value != "" {
+			attributes[attribute] = value
+		}
+	}
+	return attributes
+}
+
+// getMountNodeAffinity returns the node affinity of the nodes where the quota directories of the
+// keep hostpath pv exist, nil is returned if the pv is not sticky to any node.
+func getMountNodeAffinity(pv *v1.PersistentVolume) (*v1.VolumeNodeAffinity, error) {
+	if algorithm.IsKeepHostPathPV(pv) == false {
+		return nil, nil
+	}
+	mountInfos, err := algorithm.GetHostPathPVMountInfoList(pv)
+	if err != nil {
+		return nil, err
+	}
+	nodes := []string{}
+	for _, info := range mountInfos {
+		if len(info.MountInfos) > 0 {
+			nodes = append(nodes, info.NodeName)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+	sort.Strings(nodes)
+	return &v1.VolumeNodeAffinity{
+		Required: &v1.NodeSelector{
+			NodeSelectorTerms: []v1.NodeSelectorTerm{
+				{
+					MatchExpressions: []v1.NodeSelectorRequirement{
+						{Key: nodeHostNameLabel, Operator: v1.NodeSelectorOpIn, Values: nodes},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// preserveCapacity sets the storage capacity of the pv from its quota capacity if it is not set
+func preserveCapacity(pv *v1.PersistentVolume) error {
+	if _, exist := pv.Spec.Capacity[v1.ResourceStorage]; exist {
+		return nil
+	}
+	capacity, err := algorithm.GetHostPathPVCapacity(pv)
+	if err != nil || capacity == 0 {
+		return err
+	}
+	if pv.Spec.Capacity == nil {
+		pv.Spec.Capacity = make(v1.ResourceList)
+	}
+	pv.Spec.Capacity[v1.ResourceStorage] = *resource.NewQuantity(capacity, resource.BinarySI)
+	return nil
+}
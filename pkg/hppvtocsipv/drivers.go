@@ -0,0 +1,286 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// DriverRule converts the hostpath pvs matching all its conditions to Driver,
+// an empty condition matches all pvs.
+type DriverRule struct {
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	Driver   string `json:"driver"`
+	// StorageClasses matches the pvs of any of the storage classes
+	StorageClasses []string `json:"storageClasses,omitempty"`
+	// PVSelector matches the labels of the pvs
+	PVSelector *metav1.LabelSelector `json:"pvSelector,omitempty"`
+	// Annotations matches the pvs having all the annotations
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// NodeSelector matches the pvs whose nodes (by node affinity or existing quota directories)
+	// all match the labels, the pvs not sticky to any node do not match.
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+
+	pvSelector   labels.Selector
+	nodeSelector labels.Selector
+}
+
+// DriverRules is the rules table, the rule of the highest priority matching the pv is used
+// and DefaultDriver is used if no rule matches.
+type DriverRules struct {
+	DefaultDriver string       `json:"defaultDriver"`
+	Rules         []DriverRule `json:"rules"`
+}
+
+// NewDefaultDriverRules returns the rules which convert all pvs to driver
+func NewDefaultDriverRules(driver string) *DriverRules {
+	return &DriverRules{DefaultDriver: driver}
+}
+
+// LoadDriverRules reads the rules from the yaml or json file, defaultDriver is used if the file does not set it
+func LoadDriverRules(file, defaultDriver string) (*DriverRules, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read driver rules file %s err:%v", file, err)
+	}
+	rules := &DriverRules{}
+	if err := yaml.Unmarshal(buf, rules); err != nil {
+		return nil, fmt.Errorf("parse driver rules file %s err:%v", file, err)
+	}
+	if err := rules.complete(defaultDriver); err != nil {
+		return nil, fmt.Errorf("driver rules file %s: %v", file, err)
+	}
+	return rules, nil
+}
+
+// complete validates the rules, compiles their selectors and sorts them by priority
+func (r *DriverRules) complete(defaultDriver string) error {
+	if r.DefaultDriver == "" {
+		r.DefaultDriver = defaultDriver
+	}
+	var err error
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if rule.Driver == "" {
+			return fmt.Errorf("rule %q has no driver", rule.Name)
+		}
+		if rule.pvSelector, err = toSelector(rule.PVSelector); err != nil {
+			return fmt.Errorf("rule %q has invalid pvSelector: %v", rule.Name, err)
+		}
+		if rule.nodeSelector, err = toSelector(rule.NodeSelector); err != nil {
+			return fmt.Errorf("rule %q has invalid nodeSelector: %v", rule.Name, err)
+		}
+	}
+	sort.SliceStable(r.Rules, func(i, j int) bool {
+		return r.Rules[i].Priority > r.Rules[j].Priority
+	})
+	return nil
+}
+
+// toSelector returns nil if selector is not set
+func toSelector(selector *metav1.LabelSelector) (labels.Selector, error) {
+	if selector == nil {
+		return nil, nil
+	}
+	return metav1.LabelSelectorAsSelector(selector)
+}
+
+// getPVNodes returns the nodes the pv is restricted to by the hostname node affinity
+func getPVNodes(pv *v1.PersistentVolume) []string {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return nil
+	}
+	nodes := []string{}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, r := range term.MatchExpressions {
+			if r.Key == nodeHostNameLabel && r.Operator == v1.NodeSelectorOpIn {
+				nodes = append(nodes, r.Values...)
+			}
+		}
+	}
+	return nodes
+}
+
+func (rule *DriverRule) match(pv *v1.PersistentVolume, nodeLister corelisters.NodeLister) (bool, error) {
+	if len(rule.StorageClasses) > 0 {
+		matched := false
+		for _, class := range rule.StorageClasses {
+			matched = matched || class == pv.Spec.StorageClassName
+		}
+		if matched == false {
+			return false, nil
+		}
+	}
+	if rule.pvSelector != nil && rule.pvSelector.Matches(labels.Set(pv.Labels)) == false {
+		return false, nil
+	}
+	for k, v := range rule.Annotations {
+		if value, exist := pv.Annotations[k]; exist == false || value != v {
+			return false, nil
+		}
+	}
+	if rule.nodeSelector == nil {
+		return true, nil
+	}
+	nodes := getPVNodes(pv)
+	if len(nodes) == 0 || nodeLister == nil {
+		return false, nil
+	}
+	for _, name := range nodes {
+		node, err := nodeLister.Get(name)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		if rule.nodeSelector.Matches(labels.Set(node.Labels)) == false {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// match returns the driver of the pv and the name of the matched rule,
+// the rule name is empty if the default driver is used.
+func (r *DriverRules) match(pv *v1.PersistentVolume, nodeLister corelisters.NodeLister) (driver, ruleName string, err error) {
+	for i := range r.Rules {
+		if matched, err := r.Rules[i].match(pv, nodeLister); err != nil {
+			return "", "", fmt.Errorf("match driver rule %q err:%v", r.Rules[i].Name, err)
+		} else if matched {
+			return r.Rules[i].Driver, r.Rules[i].Name, nil
+		}
+	}
+	return r.DefaultDriver, "", nil
+}
+
+// csiNode is the part of the CSINode (or the alpha CSINodeInfo) objects used here
+type csiNode struct {
+	Spec struct {
+		Drivers []struct {
+			Name string `json:"name"`
+		} `json:"drivers"`
+	} `json:"spec"`
+}
+
+// DriverChecker checks whether a csi driver is registered to the cluster and the nodes by its
+// CSIDriver and CSINode objects. The objects are read through the raw api paths so that both
+// storage.k8s.io/v1beta1 and the alpha csi.storage.k8s.io/v1alpha1 crds can be used.
+type DriverChecker struct {
+	client       *kubernetes.Clientset
+	groupVersion string
+	nodeResource string
+}
+
+// NewDriverChecker constructs new DriverChecker, the csinodes are named csinodeinfos in csi.storage.k8s.io/v1alpha1
+func NewDriverChecker(client *kubernetes.Clientset, groupVersion string) *DriverChecker {
+	nodeResource := "csinodes"
+	if strings.HasPrefix(groupVersion, "csi.storage.k8s.io/") {
+		nodeResource = "csinodeinfos"
+	}
+	return &DriverChecker{
+		client:       client,
+		groupVersion: groupVersion,
+		nodeResource: nodeResource,
+	}
+}
+
+func (c *DriverChecker) get(resource, name string) ([]byte, error) {
+	return c.client.CoreV1().RESTClient().Get().AbsPath("/apis", c.groupVersion, resource, name).
+		Timeout(5 * time.Second).Do().Raw()
+}
+
+// Check returns an error if driver has no CSIDriver object or is not registered on any of nodes,
+// it must be registered on at least one node if nodes is empty.
+func (c *DriverChecker) Check(driver string, nodes []string) error {
+	if c == nil {
+		return nil
+	}
+	if _, err := c.get("csidrivers", driver); err != nil {
+		if errors.IsNotFound(err) {
+			return fmt.Errorf("csi driver %s has no CSIDriver object", driver)
+		}
+		return fmt.Errorf("get CSIDriver %s err:%v", driver, err)
+	}
+	if len(nodes) > 0 {
+		missing := []string{}
+		for _, node := range nodes {
+			if registered, err := c.isRegistered(driver, node); err != nil {
+				return err
+			} else if registered == false {
+				missing = append(missing, node)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("csi driver %s is not registered on nodes %s", driver, strings.Join(missing, ","))
+		}
+		return nil
+	}
+	buf, err := c.get(c.nodeResource, "")
+	if err != nil {
+		return fmt.Errorf("list %s err:%v", c.nodeResource, err)
+	}
+	list := struct {
+		Items []csiNode `json:"items"`
+	}{}
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return fmt.Errorf("decode %s err:%v", c.nodeResource, err)
+	}
+	for _, item := range list.Items {
+		if item.hasDriver(driver) {
+			return nil
+		}
+	}
+	return fmt.Errorf("csi driver %s is not registered on any node", driver)
+}
+
+func (n *csiNode) hasDriver(driver string) bool {
+	for _, d := range n.Spec.Drivers {
+		if d.Name == driver {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *DriverChecker) isRegistered(driver, node string) (bool, error) {
+	buf, err := c.get(c.nodeResource, node)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("get %s %s err:%v", c.nodeResource, node, err)
+	}
+	obj := csiNode{}
+	if err := json.Unmarshal(buf, &obj); err != nil {
+		return false, fmt.Errorf("decode %s %s err:%v", c.nodeResource, node, err)
+	}
+	return obj.hasDriver(driver), nil
+}
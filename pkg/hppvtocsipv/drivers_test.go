@@ -0,0 +1,139 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestNodeLister(t *testing.T, nodes map[string]map[string]string) corelisters.NodeLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for name, nodeLabels := range nodes {
+		node := &v1.Node{}
+		node.Name = name
+		node.Labels = nodeLabels
+		if err := indexer.Add(node); err != nil {
+			t.Fatalf("add node %s err:%v", name, err)
+		}
+	}
+	return corelisters.NewNodeLister(indexer)
+}
+
+func newTestPV(storageClass string, pvLabels, annotations map[string]string, nodes ...string) *v1.PersistentVolume {
+	pv := &v1.PersistentVolume{}
+	pv.Name = "pv1"
+	pv.Labels = pvLabels
+	pv.Annotations = annotations
+	pv.Spec.StorageClassName = storageClass
+	if len(nodes) > 0 {
+		pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+			Required: &v1.NodeSelector{
+				NodeSelectorTerms: []v1.NodeSelectorTerm{
+					{
+						MatchExpressions: []v1.NodeSelectorRequirement{
+							{Key: nodeHostNameLabel, Operator: v1.NodeSelectorOpIn, Values: nodes},
+						},
+					},
+				},
+			},
+		}
+	}
+	return pv
+}
+
+func TestDriverRulesMatch(t *testing.T) {
+	nodeLister := newTestNodeLister(t, map[string]map[string]string{
+		"node1": {"disk": "ssd"},
+		"node2": {"disk": "ssd"},
+		"node3": {"disk": "hdd"},
+	})
+	ssd := &metav1.LabelSelector{MatchLabels: map[string]string{"disk": "ssd"}}
+	rules := &DriverRules{
+		Rules: []DriverRule{
+			{Name: "low", Priority: 1, Driver: "low.csi", StorageClasses: []string{"fast", "slow"}},
+			{Name: "high", Priority: 10, Driver: "high.csi", StorageClasses: []string{"fast"}},
+			{Name: "labels", Priority: 5, Driver: "labels.csi", PVSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}},
+			{Name: "annotations", Priority: 5, Driver: "annotations.csi", Annotations: map[string]string{"owner": "team1"}},
+			{Name: "nodes", Priority: 3, Driver: "nodes.csi", NodeSelector: ssd},
+		},
+	}
+	if err := rules.complete("default.csi"); err != nil {
+		t.Fatalf("complete rules err:%v", err)
+	}
+	tests := []struct {
+		name       string
+		pv         *v1.PersistentVolume
+		nodeLister corelisters.NodeLister
+		wantDriver string
+		wantRule   string
+	}{
+		{name: "higher priority first", pv: newTestPV("fast", nil, nil), nodeLister: nodeLister, wantDriver: "high.csi", wantRule: "high"},
+		{name: "lower priority", pv: newTestPV("slow", nil, nil), nodeLister: nodeLister, wantDriver: "low.csi", wantRule: "low"},
+		{name: "same priority in file order", pv: newTestPV("", map[string]string{"app": "db"}, map[string]string{"owner": "team1"}), nodeLister: nodeLister, wantDriver: "labels.csi", wantRule: "labels"},
+		{name: "annotations", pv: newTestPV("", nil, map[string]string{"owner": "team1"}), nodeLister: nodeLister, wantDriver: "annotations.csi", wantRule: "annotations"},
+		{name: "annotation value differs", pv: newTestPV("", nil, map[string]string{"owner": "team2"}), nodeLister: nodeLister, wantDriver: "default.csi"},
+		{name: "all nodes match", pv: newTestPV("", nil, nil, "node1", "node2"), nodeLister: nodeLister, wantDriver: "nodes.csi", wantRule: "nodes"},
+		{name: "a node does not match", pv: newTestPV("", nil, nil, "node1", "node3"), nodeLister: nodeLister, wantDriver: "default.csi"},
+		{name: "node not found", pv: newTestPV("", nil, nil, "node4"), nodeLister: nodeLister, wantDriver: "default.csi"},
+		{name: "no nodes", pv: newTestPV("", nil, nil), nodeLister: nodeLister, wantDriver: "default.csi"},
+		{name: "no node lister", pv: newTestPV("", nil, nil, "node1"), nodeLister: nil, wantDriver: "default.csi"},
+	}
+	for _, test := range tests {
+		driver, rule, err := rules.match(test.pv, test.nodeLister)
+		if err != nil {
+			t.Errorf("%s: unexpected err:%v", test.name, err)
+			continue
+		}
+		if driver != test.wantDriver || rule != test.wantRule {
+			t.Errorf("%s: got driver %s rule %q, want driver %s rule %q", test.name, driver, rule, test.wantDriver, test.wantRule)
+		}
+	}
+}
+
+func TestDriverRulesComplete(t *testing.T) {
+	tests := []struct {
+		name              string
+		rules             DriverRules
+		wantDefaultDriver string
+		wantErr           bool
+	}{
+		{name: "default driver", rules: DriverRules{}, wantDefaultDriver: "default.csi"},
+		{name: "default driver set", rules: DriverRules{DefaultDriver: "file.csi"}, wantDefaultDriver: "file.csi"},
+		{name: "no driver", rules: DriverRules{Rules: []DriverRule{{Name: "r1"}}}, wantErr: true},
+		{
+			name: "invalid selector",
+			rules: DriverRules{Rules: []DriverRule{{Name: "r1", Driver: "r1.csi", PVSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: "Unknown"}},
+			}}}},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		err := test.rules.complete("default.csi")
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected err:%v", test.name, err)
+			continue
+		}
+		if err == nil && test.rules.DefaultDriver != test.wantDefaultDriver {
+			t.Errorf("%s: got default driver %s, want %s", test.name, test.rules.DefaultDriver, test.wantDefaultDriver)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// handleParams are the fields the volume handle template can use
+type handleParams struct {
+	// Name is the name of the pv
+	Name string
+	// Namespace and ClaimName are of the claimRef of the pv, empty if the pv is not pre-bound
+	Namespace string
+	ClaimName string
+	ClusterID string
+	// UID is the uid of the pv, a uuid derived from ClusterID and Name is used if the pv has no uid yet
+	UID string
+}
+
+// VolumeHandleGenerator generates the csi volume handles of the converted hostpath pvs,
+// the handles are derived from the raw pv if the template is not set.
+type VolumeHandleGenerator struct {
+	tmpl      *template.Template
+	clusterID string
+	pvLister  corelisters.PersistentVolumeLister
+}
+
+// NewVolumeHandleGenerator constructs new VolumeHandleGenerator, the template such as
+// csi-xfshostpath-{{.Namespace}}-{{.Name}} is checked by a sample pv.
+func NewVolumeHandleGenerator(handleTemplate, clusterID string, pvLister corelisters.PersistentVolumeLister) (*VolumeHandleGenerator, error) {
+	g := &VolumeHandleGenerator{
+		clusterID: clusterID,
+		pvLister:  pvLister,
+	}
+	if handleTemplate == "" {
+		return g, nil
+	}
+	tmpl, err := template.New("volumehandle").Option("missingkey=error").Parse(handleTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("parse volume handle template %q err:%v", handleTemplate, err)
+	}
+	g.tmpl = tmpl
+	sample := &v1.PersistentVolume{}
+	sample.Name = "sample"
+	sample.Spec.ClaimRef = &v1.ObjectReference{Namespace: "sample", Name: "sample"}
+	if _, err := g.execute(sample); err != nil {
+		return nil, fmt.Errorf("volume handle template %q err:%v", handleTemplate, err)
+	}
+	return g, nil
+}
+
+// getDerivedUID returns a uuid derived from the cluster id and the pv name
+func getDerivedUID(clusterID, name string) string {
+	sum := sha1.Sum([]byte(clusterID + "/" + name))
+	// version 5 and rfc4122 variant
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func (g *VolumeHandleGenerator) execute(pv *v1.PersistentVolume) (string, error) {
+	params := handleParams{
+		Name:      pv.Name,
+		ClusterID: g.clusterID,
+		UID:       string(pv.UID),
+	}
+	if params.UID == "" {
+		params.UID = getDerivedUID(g.clusterID, pv.Name)
+	}
+	if pv.Spec.ClaimRef != nil {
+		params.Namespace = pv.Spec.ClaimRef.Namespace
+		params.ClaimName = pv.Spec.ClaimRef.Name
+	}
+	var buf bytes.Buffer
+	if err := g.tmpl.Execute(&buf, params); err != nil {
+		return "", err
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("volume handle of pv %s is empty", pv.Name)
+	}
+	// the quota path of the csi driver is named as k8squota_<volume handle>[_pod] and is split by _
+	if strings.Contains(buf.String(), "_") {
+		return "", fmt.Errorf("volume handle %s of pv %s should not contain _", buf.String(), pv.Name)
+	}
+	return buf.String(), nil
+}
+
+// Generate returns the volume handle of the hostpath pv whose raw object is raw
+func (g *VolumeHandleGenerator) Generate(pv *v1.PersistentVolume, raw []byte) (string, error) {
+	if g.tmpl == nil {
+		return GetGuid(raw), nil
+	}
+	handle, err := g.execute(pv)
+	if err != nil {
+		return "", fmt.Errorf("generate volume handle of pv %s err:%v", pv.Name, err)
+	}
+	return handle, nil
+}
+
+// GetHandleOwner returns the csi pv of driverName other than pvName which uses the volume handle,
+// empty is returned if there is none.
+func (g *VolumeHandleGenerator) GetHandleOwner(pvName, handle, driverName string) (string, error) {
+	if g.pvLister == nil {
+		return "", nil
+	}
+	pvs, err := g.pvLister.List(labels.Everything())
+	if err != nil {
+		return "", err
+	}
+	for _, pv := range pvs {
+		if pv.Name == pvName || pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+		if pv.Spec.CSI.VolumeHandle == handle {
+			return pv.Name, nil
+		}
+	}
+	return "", nil
+}
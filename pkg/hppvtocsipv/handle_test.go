@@ -0,0 +1,96 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestGetDerivedUID(t *testing.T) {
+	uuidRegexp := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	tests := []struct {
+		clusterID string
+		name      string
+	}{
+		{clusterID: "", name: ""},
+		{clusterID: "cluster1", name: "pv1"},
+		{clusterID: "cluster1", name: "pv2"},
+		{clusterID: "cluster2", name: "pv1"},
+		{clusterID: "cluster1/pv1", name: ""},
+	}
+	seen := map[string]string{}
+	for _, test := range tests {
+		uid := getDerivedUID(test.clusterID, test.name)
+		if uuidRegexp.MatchString(uid) == false {
+			t.Errorf("uid %s of %s/%s is not a version 5 uuid", uid, test.clusterID, test.name)
+		}
+		if again := getDerivedUID(test.clusterID, test.name); again != uid {
+			t.Errorf("uid of %s/%s is not stable: %s != %s", test.clusterID, test.name, uid, again)
+		}
+		key := test.clusterID + "/" + test.name
+		if other, exist := seen[uid]; exist && other != key {
+			t.Errorf("%s and %s have the same uid %s", other, key, uid)
+		}
+		seen[uid] = key
+	}
+}
+
+func TestVolumeHandleGenerator(t *testing.T) {
+	tests := []struct {
+		name        string
+		template    string
+		pvUID       string
+		claim       *v1.ObjectReference
+		want        string
+		wantErr     bool
+		wantInitErr bool
+	}{
+		{name: "pv uid", template: "{{.UID}}", pvUID: "1234", want: "1234"},
+		{name: "derived uid", template: "{{.UID}}", want: getDerivedUID("cluster1", "pv1")},
+		{name: "claim", template: "csi-{{.Namespace}}-{{.ClaimName}}", claim: &v1.ObjectReference{Namespace: "ns1", Name: "pvc1"}, want: "csi-ns1-pvc1"},
+		{name: "no claim", template: "csi-{{.Name}}-{{.Namespace}}{{.ClaimName}}", want: "csi-pv1-"},
+		{name: "cluster id", template: "{{.ClusterID}}-{{.Name}}", want: "cluster1-pv1"},
+		{name: "missing key", template: "{{.Unknown}}", wantInitErr: true},
+		{name: "underscore in template", template: "csi_{{.Name}}", wantInitErr: true},
+		{name: "underscore in claim", template: "{{.ClaimName}}", claim: &v1.ObjectReference{Namespace: "ns1", Name: "pvc_1"}, wantErr: true},
+	}
+	for _, test := range tests {
+		g, err := NewVolumeHandleGenerator(test.template, "cluster1", nil)
+		if (err != nil) != test.wantInitErr {
+			t.Errorf("%s: unexpected init err:%v", test.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		pv := &v1.PersistentVolume{}
+		pv.Name = "pv1"
+		pv.UID = types.UID(test.pvUID)
+		pv.Spec.ClaimRef = test.claim
+		handle, err := g.Generate(pv, nil)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected err:%v", test.name, err)
+			continue
+		}
+		if err == nil && handle != test.want {
+			t.Errorf("%s: got handle %s, want %s", test.name, handle, test.want)
+		}
+	}
+}
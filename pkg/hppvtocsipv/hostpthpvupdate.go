@@ -11,10 +11,13 @@ import (
 
 	"github.com/golang/glog"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
@@ -23,6 +26,9 @@ const (
 	updatingPipelineStartTime = "io.enndata.hppvtocsipv/updatingPipelineStartTime"
 )
 
+// errPipelineStopped is returned by the steps which are interrupted by the stop of the pipeline
+var errPipelineStopped = fmt.Errorf("pipeline is stopped")
+
 type UndoAction func(exitOk bool) (err error)
 type Action func() (c bool, undo UndoAction, err error)
 
@@ -34,6 +40,7 @@ func getNowTimeStr() string {
 type PipelineStep struct {
 	name    string
 	action  Action
+	undo    UndoAction
 	timeOut time.Duration
 }
 
@@ -43,9 +50,24 @@ type UpdatePipeline struct {
 	needWaitBound bool
 	ret           chan error
 	saveOldPV     *v1.PersistentVolume
+	csiPV         *v1.PersistentVolume
+	server        *AdmissionServer
 	upgradeImage  string
 	updateSteps   []PipelineStep
 	stop          <-chan struct{}
+	onStep        func(step string)
+	completed     bool
+	journal       *journalStore
+	owner         string
+	plan          string
+	changePods    []string
+	doneSteps     []string
+	rollingBack   bool
+	// interruptedStep is the first step not done of a restored pipeline, its undo is registered
+	// by restore since it may have been interrupted halfway
+	interruptedStep string
+	undoActions     []UndoAction
+	abandoned       bool
 }
 
 func (upl *UpdatePipeline) TimeOut() time.Duration {
@@ -66,11 +88,13 @@ func (upl *UpdatePipeline) isTimeOut(startTimeStr string) (bool, error) {
 }
 
 func (upl *UpdatePipeline) stepCheck() (c bool, undo UndoAction, err error) {
-	var pipelineName string
-	if hostname, err := os.Hostname(); err != nil {
-		return false, nil, err
-	} else {
-		pipelineName = hostname
+	pipelineName := upl.owner
+	if pipelineName == "" {
+		if hostname, err := os.Hostname(); err != nil {
+			return false, nil, err
+		} else {
+			pipelineName = hostname
+		}
 	}
 	pv, err := upl.client.Core().PersistentVolumes().Get(upl.pvName, metav1.GetOptions{})
 	if err != nil {
@@ -94,26 +118,31 @@ func (upl *UpdatePipeline) stepCheck() (c bool, undo UndoAction, err error) {
 	if errUpdate != nil {
 		return false, nil, errUpdate
 	}
-	undo = func(exitOk bool) error {
-		if exitOk {
+	upl.owner = pipelineName
+	return true, upl.undoCheck, nil
+}
+
+func (upl *UpdatePipeline) undoCheck(exitOk bool) error {
+	if exitOk {
+		return nil
+	}
+	curPV, err := upl.client.Core().PersistentVolumes().Get(upl.pvName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
 			return nil
 		}
-		curPV, err := upl.client.Core().PersistentVolumes().Get(upl.pvName, metav1.GetOptions{})
-		if err != nil {
-			return err
-		}
-		delete(curPV.Annotations, updatingPipelineName)
-		delete(curPV.Annotations, updatingPipelineStartTime)
-		if len(curPV.Annotations) == 0 {
-			curPV.Annotations = nil
-		}
-		_, errUpdate := upl.client.Core().PersistentVolumes().Update(curPV)
-		if errUpdate != nil {
-			return errUpdate
-		}
-		return nil
+		return err
 	}
-	return true, undo, nil
+	delete(curPV.Annotations, updatingPipelineName)
+	delete(curPV.Annotations, updatingPipelineStartTime)
+	if len(curPV.Annotations) == 0 {
+		curPV.Annotations = nil
+	}
+	_, errUpdate := upl.client.Core().PersistentVolumes().Update(curPV)
+	if errUpdate != nil {
+		return errUpdate
+	}
+	return nil
 }
 
 func (upl *UpdatePipeline) stepCreatePodToChangeQuotaType() (c bool, undo UndoAction, err error) {
@@ -127,18 +156,83 @@ func (upl *UpdatePipeline) stepCreatePodToChangeQuotaType() (c bool, undo UndoAc
 	if errInfo != nil {
 		return false, nil, errInfo
 	}
-	pods, err := hostpathcmd.CreatePodsToChangeQuotaPathType(upl.client, upl.pvName, upl.upgradeImage, nodeMountInfos)
-
-	undo = func(exitOk bool) error {
-		return hostpathcmd.WaitPodsDeleted(upl.client, "", pods, true)
+	// the pods left by an interrupted run of the step are deleted before they are created again
+	if err := upl.undoCreatePodToChangeQuotaType(false); err != nil {
+		return false, nil, err
+	}
+	// the pods are journaled before they are created so that they are deleted if the step is interrupted
+	upl.changePods = make([]string, 0, len(nodeMountInfos))
+	for nodeName := range nodeMountInfos {
+		upl.changePods = append(upl.changePods, getChangePodKey(nodeName, upl.pvName))
+	}
+	if err := upl.saveJournal(); err != nil {
+		return false, nil, err
 	}
+	pods, err := hostpathcmd.CreatePodsToChangeQuotaPathType(upl.client, upl.pvName, upl.upgradeImage, nodeMountInfos)
 	if err != nil {
-		return false, undo, err
+		return false, upl.undoCreatePodToChangeQuotaType, err
+	}
+	if err := upl.waitPodsQuit(pods, 120*time.Second); err != nil {
+		return false, upl.undoCreatePodToChangeQuotaType, err
+	}
+	return true, upl.undoCreatePodToChangeQuotaType, nil
+}
+
+// poll checks condition every second until it returns true, timeout passes or the pipeline is stopped
+func (upl *UpdatePipeline) poll(timeout time.Duration, condition func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if ok, err := condition(); err != nil || ok {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout after %v", timeout)
+		}
+		select {
+		case <-upl.stop:
+			return errPipelineStopped
+		case <-time.After(time.Second):
+		}
 	}
-	if err := hostpathcmd.WaitPodQuit(upl.client, pods, 120); err != nil {
-		return false, undo, err
+}
+
+// waitPodsQuit is the same as hostpathcmd.WaitPodQuit but returns when the pipeline is stopped
+func (upl *UpdatePipeline) waitPodsQuit(pods []*v1.Pod, timeout time.Duration) error {
+	return upl.poll(timeout, func() (bool, error) {
+		for _, pod := range pods {
+			curPod, err := upl.client.Core().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
+			if err != nil {
+				if errors.IsNotFound(err) {
+					return true, nil
+				}
+				return false, err
+			}
+			if curPod.Status.Phase == v1.PodFailed {
+				return false, fmt.Errorf("pod:%s is failed", pod.Name)
+			} else if curPod.Status.Phase != v1.PodSucceeded {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
+
+// getChangePodKey returns the key of the pod changing the quota path type of pv on node,
+// it is named the same as hostpathcmd.CreatePodsToChangeQuotaPathType does.
+func getChangePodKey(nodeName, pvName string) string {
+	return fmt.Sprintf("%s/change-%s-%s-quotapath-tmppod", metav1.NamespaceSystem, nodeName, pvName)
+}
+
+func (upl *UpdatePipeline) undoCreatePodToChangeQuotaType(exitOk bool) error {
+	pods := make([]*v1.Pod, 0, len(upl.changePods))
+	for _, key := range upl.changePods {
+		namespace, name, err := cache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			return err
+		}
+		pods = append(pods, &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}})
 	}
-	return true, undo, nil
+	return hostpathcmd.WaitPodsDeleted(upl.client, "", pods, true)
 }
 
 func (upl *UpdatePipeline) Done() chan error {
@@ -153,55 +247,144 @@ func (upl *UpdatePipeline) stepCreateTmpPV() (c bool, undo UndoAction, err error
 		return false, nil, fmt.Errorf("pv %s is not hostpathpv", pv.Name)
 	}
 
-	tmpPvName := fmt.Sprintf("%s-csihostpathpv-tmp", hostpathcmd.GetMd5Hash(pv.Name, 10))
-	if err := hostpathcmd.CreateCSIHostPathPV(upl.client, tmpPvName, pv, false); err != nil {
+	if err := hostpathcmd.CreateCSIHostPathPV(upl.client, upl.getTmpPVName(), pv, false); err != nil && !errors.IsAlreadyExists(err) {
 		return false, nil, err
 	}
-	undo = func(exitOk bool) error {
-		return hostpathcmd.DeletePv(upl.client, tmpPvName)
+	return true, upl.undoCreateTmpPV, nil
+}
+
+func (upl *UpdatePipeline) getTmpPVName() string {
+	return fmt.Sprintf("%s-csihostpathpv-tmp", hostpathcmd.GetMd5Hash(upl.pvName, 10))
+}
+
+func (upl *UpdatePipeline) undoCreateTmpPV(exitOk bool) error {
+	return deletePVIf(upl.client, upl.getTmpPVName(), nil)
+}
+
+// deletePVIf deletes the pv if it exists and match returns true
+func deletePVIf(client *kubernetes.Clientset, pvName string, match func(pv *v1.PersistentVolume) bool) error {
+	pv, err := client.Core().PersistentVolumes().Get(pvName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
 	}
-	return true, undo, nil
+	if match != nil && match(pv) == false {
+		return nil
+	}
+	return hostpathcmd.DeletePv(client, pvName)
 }
 
 func (upl *UpdatePipeline) stepDeleteOldPV() (c bool, undo UndoAction, err error) {
 	pv, err := upl.client.Core().PersistentVolumes().Get(upl.pvName, metav1.GetOptions{})
 	if err != nil {
+		if errors.IsNotFound(err) && upl.saveOldPV != nil {
+			// deleted before the pipeline was interrupted
+			return true, upl.undoDeleteOldPV, nil
+		}
 		return false, nil, err
 	} else if pv.Spec.HostPath == nil {
 		return false, nil, fmt.Errorf("pv %s is not hostpathpv", pv.Name)
 	}
+	// convert the pv before deleting it so that a pv which can not be converted is kept
+	csiPV, err := upl.getCSIPV(pv)
+	if err != nil {
+		return false, nil, err
+	}
 	upl.saveOldPV = pv
+	upl.csiPV = csiPV
+	if err := upl.saveJournal(); err != nil {
+		return false, nil, err
+	}
 	errDelete := hostpathcmd.DeletePv(upl.client, upl.pvName)
 	if errDelete != nil {
-		return false, nil, errDelete
+		return false, upl.undoDeleteOldPV, errDelete
 	}
-	undo = func(exitOk bool) error {
-		if exitOk {
-			return nil
-		}
-		_, errCreate := upl.client.Core().PersistentVolumes().Create(pv)
+	return true, upl.undoDeleteOldPV, nil
+}
+
+func (upl *UpdatePipeline) undoDeleteOldPV(exitOk bool) error {
+	if exitOk || upl.saveOldPV == nil {
+		return nil
+	}
+	pv := upl.saveOldPV.DeepCopy()
+	pv.ResourceVersion = ""
+	_, errCreate := upl.client.Core().PersistentVolumes().Create(pv)
+	if errCreate != nil && !errors.IsAlreadyExists(errCreate) {
 		return errCreate
 	}
-	return true, undo, nil
+	return nil
+}
+
+func isCSIPV(pv *v1.PersistentVolume) bool {
+	return pv.Spec.CSI != nil
 }
 
 func (upl *UpdatePipeline) stepCreateCSIPV() (c bool, undo UndoAction, err error) {
-	if err := hostpathcmd.CreateCSIHostPathPV(upl.client, upl.pvName, upl.saveOldPV, true); err != nil {
+	if pv, err := upl.client.Core().PersistentVolumes().Get(upl.pvName, metav1.GetOptions{}); err == nil {
+		if isCSIPV(pv) == false {
+			return false, nil, fmt.Errorf("pv %s is recreated and is not csi pv", upl.pvName)
+		}
+		// created before the pipeline was interrupted
+		return true, upl.undoCreateCSIPV, nil
+	} else if !errors.IsNotFound(err) {
 		return false, nil, err
-	} else {
-		undo = func(exitOk bool) error {
-			if exitOk {
-				return nil
-			}
-			return hostpathcmd.DeletePv(upl.client, upl.pvName)
+	}
+	if upl.csiPV == nil {
+		csiPV, err := upl.getCSIPV(upl.saveOldPV)
+		if err != nil {
+			return false, nil, err
 		}
-		return true, undo, nil
+		upl.csiPV = csiPV
 	}
+	if _, err := upl.client.Core().PersistentVolumes().Create(upl.csiPV); err != nil {
+		return false, nil, err
+	}
+	return true, upl.undoCreateCSIPV, nil
+}
+
+// getCSIPV builds the csi pv replacing oldPV the same way as the web hook converts the new hostpath pvs,
+// so the driver rules, the driver check and the volume attributes apply. The volume handle is kept as
+// the uid of oldPV since the csi driver finds the existing quota paths of the pv by it.
+func (upl *UpdatePipeline) getCSIPV(oldPV *v1.PersistentVolume) (*v1.PersistentVolume, error) {
+	copyPV := oldPV.DeepCopy()
+	// the pv is converted with the uid and the claimRef of oldPV so that the rules see the same pv
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        copyPV.Name,
+			UID:         copyPV.UID,
+			Labels:      copyPV.Labels,
+			Annotations: copyPV.Annotations,
+		},
+		Spec: copyPV.Spec,
+	}
+	if _, err := upl.server.convertHostPathPV(pv, nil, string(oldPV.UID)); err != nil {
+		return nil, fmt.Errorf("convert pv %s err:%v", oldPV.Name, err)
+	}
+	// the new pv gets its own uid and the pvc is bound to it by its volumeName
+	pv.UID = ""
+	pv.Spec.ClaimRef = nil
+	return pv, nil
+}
+
+func (upl *UpdatePipeline) undoCreateCSIPV(exitOk bool) error {
+	if exitOk {
+		return nil
+	}
+	// the old pv may have been recreated with the same name by a former rollback
+	return deletePVIf(upl.client, upl.pvName, isCSIPV)
 }
 
 func (upl *UpdatePipeline) stepWaitCSIPVBound() (c bool, undo UndoAction, err error) {
 	if upl.needWaitBound == true {
-		err := hostpathcmd.WaitPVBound(upl.client, upl.pvName, 40)
+		err := upl.poll(40*time.Second, func() (bool, error) {
+			pv, err := upl.client.Core().PersistentVolumes().Get(upl.pvName, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			return pv.Status.Phase == v1.VolumeBound, nil
+		})
 		if err != nil {
 			return false, nil, err
 		}
@@ -212,44 +395,142 @@ func (upl *UpdatePipeline) stepWaitCSIPVBound() (c bool, undo UndoAction, err er
 func (upl *UpdatePipeline) stepRestartPods() (c bool, undo UndoAction, err error) {
 	dps, deleteNames, err := hostpathcmd.GetPVsUsingPods(upl.client, []string{upl.pvName})
 	glog.Infof("UpdatePipeline start restart pods %v of pv %s", deleteNames, upl.pvName)
-	errDelete := hostpathcmd.DeletePods(upl.client, "", dps, 1*time.Minute)
-	if errDelete != nil {
-		glog.Errorf("UpdatePipeline delete pods err:%v", errDelete)
+	for i, pod := range dps {
+		if i > 0 {
+			// restart the pods one by one like hostpathcmd.DeletePods
+			select {
+			case <-upl.stop:
+				return false, nil, errPipelineStopped
+			case <-time.After(1 * time.Minute):
+			}
+		}
+		errDelete := upl.client.Core().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &pod.UID},
+		})
+		if errDelete != nil && !errors.IsNotFound(errDelete) {
+			glog.Errorf("UpdatePipeline delete pod %s:%s err:%v", pod.Namespace, pod.Name, errDelete)
+		}
 	}
 	return true, nil, nil
 }
 
+func (upl *UpdatePipeline) isStepDone(name string) bool {
+	for _, step := range upl.doneSteps {
+		if step == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (upl *UpdatePipeline) getJournal() *PipelineJournal {
+	return &PipelineJournal{
+		PVName:        upl.pvName,
+		Owner:         upl.owner,
+		Plan:          upl.plan,
+		NeedWaitBound: upl.needWaitBound,
+		Steps:         upl.doneSteps,
+		ChangePods:    upl.changePods,
+		OldPV:         upl.saveOldPV,
+		CSIPV:         upl.csiPV,
+		RollingBack:   upl.rollingBack,
+	}
+}
+
+// saveJournal persists the state of the pipeline, nothing is saved before the Check step
+// is done since the pv is not touched before it
+func (upl *UpdatePipeline) saveJournal() error {
+	if upl.journal == nil || upl.owner == "" {
+		return nil
+	}
+	return upl.journal.save(upl.getJournal())
+}
+
+// restore loads the state of an interrupted pipeline from its journal
+func (upl *UpdatePipeline) restore(j *PipelineJournal) {
+	upl.owner = j.Owner
+	upl.plan = j.Plan
+	upl.needWaitBound = j.NeedWaitBound
+	upl.doneSteps = j.Steps
+	upl.changePods = j.ChangePods
+	upl.saveOldPV = j.OldPV
+	upl.csiPV = j.CSIPV
+	upl.rollingBack = j.RollingBack
+	upl.undoActions = []UndoAction{}
+	for _, step := range upl.updateSteps {
+		if upl.isStepDone(step.name) {
+			if step.undo != nil {
+				upl.undoActions = append(upl.undoActions, step.undo)
+			}
+			continue
+		}
+		upl.interruptedStep = step.name
+		if step.undo != nil {
+			upl.undoActions = append(upl.undoActions, step.undo)
+		}
+		break
+	}
+}
+
+// undo runs the undo actions of the done steps in reverse order, the journal is deleted if all of them succeed
+func (upl *UpdatePipeline) undo(exitOk bool) error {
+	glog.Infof("start recover of pv %s", upl.pvName)
+	if exitOk == false && upl.rollingBack == false {
+		upl.rollingBack = true
+		if err := upl.saveJournal(); err != nil {
+			glog.Errorf("save journal of pv %s err:%v", upl.pvName, err)
+		}
+	}
+	errs := make([]error, 0, len(upl.undoActions))
+	for i := len(upl.undoActions) - 1; i >= 0; i-- {
+		undo := upl.undoActions[i]
+		if err := undo(exitOk); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	upl.undoActions = []UndoAction{}
+	glog.Infof("end recover of %s errs:%v", upl.pvName, errs)
+	if len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+	if upl.journal != nil && upl.owner != "" {
+		return upl.journal.delete(upl.pvName)
+	}
+	return nil
+}
+
+// rollback undoes the done steps of an interrupted pipeline
+func (upl *UpdatePipeline) rollback() error {
+	upl.rollingBack = true
+	return upl.undo(false)
+}
+
+// Run runs the steps which are not done yet, the done steps of a restored pipeline are skipped
 func (upl *UpdatePipeline) Run() {
 	var ret error
-	undoActions := make([]UndoAction, 0, len(upl.updateSteps))
 	timeOutCh := make(chan struct{}, 0)
 	go func() {
 		time.Sleep(upl.TimeOut())
 		close(timeOutCh)
 	}()
 	glog.Infof("UpdatePipeline of %s started, timeout:%v", upl.pvName, upl.TimeOut())
-	undo := func(exitOk bool) {
-		glog.Infof("start recover of pv %s", upl.pvName)
-
-		errs := make([]error, 0, len(undoActions))
-		for i := len(undoActions) - 1; i >= 0; i-- {
-			undo := undoActions[i]
-			if err := undo(exitOk); err != nil {
-				errs = append(errs, err)
-			}
-		}
-		undoActions = []UndoAction{}
-		glog.Infof("end recover of %s errs:%v", upl.pvName, errs)
-	}
 	defer func() {
-		if ret != nil {
-			undo(false)
-		} else {
-			undo(true)
+		if upl.abandoned {
+			// leave the journal to the next leader, which resumes or rolls back the pipeline
+			glog.Infof("UpdatePipeline [%s]: stopped, done steps:%v", upl.pvName, upl.doneSteps)
+			upl.ret <- ret
+			return
+		}
+		if err := upl.undo(ret == nil); err != nil {
+			glog.Errorf("UpdatePipeline [%s]: recover err:%v, the journal is kept", upl.pvName, err)
 		}
 		upl.ret <- ret
 	}()
 	for i, step := range upl.updateSteps {
+		if upl.isStepDone(step.name) {
+			glog.Infof("UpdatePipeline [%s]: Step[%d][%s]: already done\n", upl.pvName, i, step.name)
+			continue
+		}
 		stopped := false
 		glog.Infof("UpdatePipeline [%s]: Step[%d][%s]: start\n", upl.pvName, i, step.name)
 		select {
@@ -259,17 +540,22 @@ func (upl *UpdatePipeline) Run() {
 		case <-upl.stop:
 			ret = fmt.Errorf("UpdatePipeline [%s]: stopped", upl.pvName)
 			stopped = true
+			upl.abandoned = true
 		default:
 		}
 		if stopped {
 			break
 		}
+		if upl.onStep != nil {
+			upl.onStep(step.name)
+		}
 		c, undo, err := step.action()
-		if undo != nil {
-			undoActions = append(undoActions, undo)
+		if undo != nil && step.name != upl.interruptedStep {
+			upl.undoActions = append(upl.undoActions, undo)
 		}
 		if err != nil {
 			ret = err
+			upl.abandoned = err == errPipelineStopped
 			glog.Errorf("UpdatePipeline [%s]: Step[%d][%s]: action err:%v\n", upl.pvName, i, step.name, err)
 			break
 		} else if c == false {
@@ -277,7 +563,13 @@ func (upl *UpdatePipeline) Run() {
 			break
 		}
 		glog.Infof("UpdatePipeline [%s]: Step[%d][%s]: success\n", upl.pvName, i, step.name)
+		upl.doneSteps = append(upl.doneSteps, step.name)
+		if err := upl.saveJournal(); err != nil {
+			ret = fmt.Errorf("save journal err:%v", err)
+			break
+		}
 	}
+	upl.completed = ret == nil && len(upl.doneSteps) == len(upl.updateSteps)
 	glog.Infof("UpdatePipeline of %s stopped", upl.pvName)
 }
 
@@ -288,16 +580,35 @@ type PVUpdateManager struct {
 	running        bool
 	upgradeImage   string
 	mu             sync.Mutex
+	plans          *migrationPlanClient
+	pvLister       corelisters.PersistentVolumeLister
+	runningPVs     map[string]string
+	lastStart      map[string]time.Time
+	journal        *journalStore
+	server         *AdmissionServer
+	// wg tracks the goroutines running the pipelines, Stop waits for them
+	wg sync.WaitGroup
 }
 
-func NewPVUpdateManager(client *kubernetes.Clientset, updateInterval time.Duration, upgradeImage string) *PVUpdateManager {
-	return &PVUpdateManager{
+// NewPVUpdateManager creates a manager which updates all the hostpath pvs,
+// or only the pvs selected by the MigrationPlans if usePlans is true.
+// The journals of the pipelines are saved in journalNamespace, the pvs are converted by server.
+func NewPVUpdateManager(client *kubernetes.Clientset, server *AdmissionServer, updateInterval time.Duration, upgradeImage string, usePlans bool, journalNamespace string) *PVUpdateManager {
+	pvum := &PVUpdateManager{
 		client:         client,
 		updateInterval: updateInterval,
 		stopCh:         make(chan struct{}),
 		running:        false,
 		upgradeImage:   upgradeImage,
+		runningPVs:     make(map[string]string),
+		lastStart:      make(map[string]time.Time),
+		journal:        &journalStore{client: client, namespace: journalNamespace},
+		server:         server,
+	}
+	if usePlans {
+		pvum.plans = &migrationPlanClient{client: client}
 	}
+	return pvum
 }
 
 func (pvum *PVUpdateManager) Start() error {
@@ -334,18 +645,27 @@ func (pvum *PVUpdateManager) Start() error {
 			newPV := obj.(*v1.PersistentVolume)
 			if newPV.Spec.HostPath != nil && isPVWaitSync(newPV.Name) == false {
 				pvSyncAdd(newPV.Name)
-				syncPVChan <- newPV
+				select {
+				case syncPVChan <- newPV:
+				case <-pvum.stopCh:
+				}
 			}
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			newPV := newObj.(*v1.PersistentVolume)
 			if newPV.Spec.HostPath != nil && isPVWaitSync(newPV.Name) == false {
 				pvSyncAdd(newPV.Name)
-				syncPVChan <- newPV
+				select {
+				case syncPVChan <- newPV:
+				case <-pvum.stopCh:
+				}
 			}
 		},
 	}
-	pvInformer.Informer().AddEventHandler(pvEventHandlerFuncs)
+	if pvum.plans == nil {
+		pvInformer.Informer().AddEventHandler(pvEventHandlerFuncs)
+	}
+	pvum.pvLister = pvInformer.Lister()
 
 	sharedInformers.Start(pvum.stopCh)
 
@@ -353,11 +673,22 @@ func (pvum *PVUpdateManager) Start() error {
 		return fmt.Errorf("timed out waiting for namespace caches to sync")
 	}
 
-	go func() {
-		defer func() {
-			pvum.running = false
+	if pvum.plans != nil {
+		pvum.wg.Add(1)
+		go func() {
+			defer pvum.wg.Done()
+			pvum.recoverPipelines()
+			wait.Until(pvum.syncPlans, planSyncPeriod, pvum.stopCh)
 		}()
+		glog.Infof("PVUpdateManager start exit, pvs are updated by MigrationPlans")
+		return nil
+	}
+
+	pvum.wg.Add(1)
+	go func() {
+		defer pvum.wg.Done()
 
+		pvum.recoverPipelines()
 		for {
 			var pv *v1.PersistentVolume
 			select {
@@ -376,7 +707,10 @@ func (pvum *PVUpdateManager) Start() error {
 				if err != nil {
 					glog.Errorf("update pv %s to csi err:%v", pv.Name, err)
 				} else {
-					time.Sleep(pvum.updateInterval)
+					select {
+					case <-pvum.stopCh:
+					case <-time.After(pvum.updateInterval):
+					}
 				}
 			}
 		}
@@ -385,6 +719,56 @@ func (pvum *PVUpdateManager) Start() error {
 	return nil
 }
 
+// recoverPipelines resumes the interrupted pipelines which may have deleted the hostpath pvs
+// and rolls back the others
+func (pvum *PVUpdateManager) recoverPipelines() {
+	journals, err := pvum.journal.list()
+	if err != nil {
+		glog.Errorf("list journals of UpdatePipelines err:%v", err)
+		return
+	}
+	for _, j := range journals {
+		select {
+		case <-pvum.stopCh:
+			return
+		default:
+		}
+		pipeline := pvum.createPVUpdatePipeline(pvum.client, j.PVName, pvum.upgradeImage, j.NeedWaitBound, pvum.stopCh)
+		pipeline.restore(j)
+		if j.needResume() {
+			glog.Infof("resume UpdatePipeline of pv %s, done steps:%v", j.PVName, j.Steps)
+			go pipeline.Run()
+			err = <-pipeline.Done()
+		} else {
+			glog.Infof("roll back UpdatePipeline of pv %s, done steps:%v", j.PVName, j.Steps)
+			err = pipeline.rollback()
+		}
+		if pipeline.abandoned {
+			return
+		}
+		if err != nil {
+			glog.Errorf("recover UpdatePipeline of pv %s err:%v", j.PVName, err)
+		}
+		if j.Plan != "" && pvum.plans != nil {
+			pvum.modifyPVStatus(j.Plan, j.PVName, func(s *PVMigrationStatus) {
+				now := metav1.Now()
+				s.CompletionTime = &now
+				switch {
+				case err != nil:
+					s.Phase = pvPhaseFailed
+					s.Error = fmt.Sprintf("recover the interrupted migration err:%v", err)
+				case pipeline.completed:
+					s.Phase = pvPhaseSucceeded
+					s.Error = ""
+				default:
+					s.Phase = pvPhasePending
+					s.Error = "the interrupted migration is rolled back"
+				}
+			})
+		}
+	}
+}
+
 func (pvum *PVUpdateManager) createPVUpdatePipeline(client *kubernetes.Clientset, pvName, upgradeImage string, isBound bool, stop <-chan struct{}) *UpdatePipeline {
 	ret := &UpdatePipeline{
 		client:        client,
@@ -394,12 +778,14 @@ func (pvum *PVUpdateManager) createPVUpdatePipeline(client *kubernetes.Clientset
 		updateSteps:   []PipelineStep{},
 		upgradeImage:  upgradeImage,
 		stop:          stop,
-	}
-	ret.updateSteps = append(ret.updateSteps, PipelineStep{name: "Check", action: ret.stepCheck, timeOut: 3 * time.Second})
-	ret.updateSteps = append(ret.updateSteps, PipelineStep{name: "CreateChangePod", action: ret.stepCreatePodToChangeQuotaType, timeOut: 3 * time.Minute})
-	ret.updateSteps = append(ret.updateSteps, PipelineStep{name: "CreateTmpPV", action: ret.stepCreateTmpPV, timeOut: 3 * time.Second})
-	ret.updateSteps = append(ret.updateSteps, PipelineStep{name: "DeleteOldPV", action: ret.stepDeleteOldPV, timeOut: 3 * time.Second})
-	ret.updateSteps = append(ret.updateSteps, PipelineStep{name: "CreateCSIPV", action: ret.stepCreateCSIPV, timeOut: 3 * time.Second})
+		journal:       pvum.journal,
+		server:        pvum.server,
+	}
+	ret.updateSteps = append(ret.updateSteps, PipelineStep{name: "Check", action: ret.stepCheck, undo: ret.undoCheck, timeOut: 3 * time.Second})
+	ret.updateSteps = append(ret.updateSteps, PipelineStep{name: "CreateChangePod", action: ret.stepCreatePodToChangeQuotaType, undo: ret.undoCreatePodToChangeQuotaType, timeOut: 3 * time.Minute})
+	ret.updateSteps = append(ret.updateSteps, PipelineStep{name: "CreateTmpPV", action: ret.stepCreateTmpPV, undo: ret.undoCreateTmpPV, timeOut: 3 * time.Second})
+	ret.updateSteps = append(ret.updateSteps, PipelineStep{name: "DeleteOldPV", action: ret.stepDeleteOldPV, undo: ret.undoDeleteOldPV, timeOut: 3 * time.Second})
+	ret.updateSteps = append(ret.updateSteps, PipelineStep{name: "CreateCSIPV", action: ret.stepCreateCSIPV, undo: ret.undoCreateCSIPV, timeOut: 3 * time.Second})
 	ret.updateSteps = append(ret.updateSteps, PipelineStep{name: "WaitCSIPVBound", action: ret.stepWaitCSIPVBound, timeOut: 50 * time.Second})
 	ret.updateSteps = append(ret.updateSteps, PipelineStep{name: "RestartPods", action: ret.stepRestartPods, timeOut: 5 * time.Minute})
 	return ret
@@ -411,14 +797,17 @@ func (pvum *PVUpdateManager) IsRunning() bool {
 	return pvum.running
 }
 
+// Stop stops starting new pipelines and waits for the running ones to stop after their current
+// steps, so that no pv is touched by this manager after Stop returns
 func (pvum *PVUpdateManager) Stop() error {
 	pvum.mu.Lock()
-	defer pvum.mu.Unlock()
 	if pvum.running == false {
-		return nil
-	} else {
-		close(pvum.stopCh)
-		pvum.running = false
+		pvum.mu.Unlock()
 		return nil
 	}
+	close(pvum.stopCh)
+	pvum.running = false
+	pvum.mu.Unlock()
+	pvum.wg.Wait()
+	return nil
 }
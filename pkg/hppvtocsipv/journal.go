@@ -0,0 +1,148 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	hostpathcmd "github.com/Rhealb/kubectl-plugins/hostpathpv/pkg/cmd"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	journalLabel   = "io.enndata.hppvtocsipv/journal"
+	journalPVAnn   = "io.enndata.hppvtocsipv/pv"
+	journalDataKey = "journal"
+)
+
+// PipelineJournal is the persisted state of an UpdatePipeline. It is saved in a ConfigMap
+// after every step so that an interrupted pipeline can be resumed or rolled back.
+type PipelineJournal struct {
+	PVName        string `json:"pvName"`
+	Owner         string `json:"owner"`
+	Plan          string `json:"plan,omitempty"`
+	NeedWaitBound bool   `json:"needWaitBound"`
+	// Steps are the completed steps
+	Steps []string `json:"steps"`
+	// ChangePods are the namespace/name of the pods changing the quota path type
+	ChangePods []string `json:"changePods,omitempty"`
+	// OldPV is saved before the hostpath pv is deleted
+	OldPV *v1.PersistentVolume `json:"oldPV,omitempty"`
+	// CSIPV is the csi pv replacing the old pv, it is converted before the old pv is deleted
+	CSIPV *v1.PersistentVolume `json:"csiPV,omitempty"`
+	// RollingBack is set when the pipeline failed and its steps are being undone
+	RollingBack bool `json:"rollingBack,omitempty"`
+}
+
+// needResume returns true if the hostpath pv may have been deleted, the interrupted
+// pipeline is resumed then, otherwise it is rolled back
+func (j *PipelineJournal) needResume() bool {
+	return j.RollingBack == false && j.OldPV != nil
+}
+
+type journalStore struct {
+	client    *kubernetes.Clientset
+	namespace string
+}
+
+// getJournalName returns the ConfigMap name of the journal of pvName, the pv name is also saved in
+// the journalPVAnn annotation which is checked in case two pvs have the same md5.
+func getJournalName(pvName string) string {
+	return fmt.Sprintf("hppvtocsipv-journal-%s", hostpathcmd.GetMd5Hash(pvName, 32))
+}
+
+func isJournalOf(cm *v1.ConfigMap, pvName string) bool {
+	return cm.Annotations != nil && cm.Annotations[journalPVAnn] == pvName
+}
+
+func (js *journalStore) save(j *PipelineJournal) error {
+	buf, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	name := getJournalName(j.PVName)
+	cm, err := js.client.CoreV1().ConfigMaps(js.namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   js.namespace,
+				Labels:      map[string]string{journalLabel: "true"},
+				Annotations: map[string]string{journalPVAnn: j.PVName},
+			},
+			Data: map[string]string{journalDataKey: string(buf)},
+		}
+		_, err = js.client.CoreV1().ConfigMaps(js.namespace).Create(cm)
+		return err
+	}
+	if isJournalOf(cm, j.PVName) == false {
+		return fmt.Errorf("journal %s is of pv %s, not %s", name, cm.Annotations[journalPVAnn], j.PVName)
+	}
+	cm.Data = map[string]string{journalDataKey: string(buf)}
+	_, err = js.client.CoreV1().ConfigMaps(js.namespace).Update(cm)
+	return err
+}
+
+func (js *journalStore) delete(pvName string) error {
+	name := getJournalName(pvName)
+	cm, err := js.client.CoreV1().ConfigMaps(js.namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if isJournalOf(cm, pvName) == false {
+		return nil
+	}
+	err = js.client.CoreV1().ConfigMaps(js.namespace).Delete(name, &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &cm.UID}})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (js *journalStore) list() ([]*PipelineJournal, error) {
+	cms, err := js.client.CoreV1().ConfigMaps(js.namespace).List(metav1.ListOptions{LabelSelector: journalLabel + "=true"})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*PipelineJournal, 0, len(cms.Items))
+	// a bad journal is skipped so that the others are still recovered, it is left for the administrator
+	for i := range cms.Items {
+		cm := &cms.Items[i]
+		j := &PipelineJournal{}
+		if err := json.Unmarshal([]byte(cm.Data[journalDataKey]), j); err != nil {
+			glog.Errorf("skip journal %s: unmarshal err:%v", cm.Name, err)
+			continue
+		}
+		if isJournalOf(cm, j.PVName) == false || cm.Name != getJournalName(j.PVName) {
+			glog.Errorf("skip journal %s: it is not the journal of pv %s", cm.Name, j.PVName)
+			continue
+		}
+		ret = append(ret, j)
+	}
+	return ret, nil
+}
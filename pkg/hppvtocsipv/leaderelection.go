@@ -0,0 +1,227 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// LeaderElector elects one leader among the replicas by a coordination Lease
+type LeaderElector struct {
+	client        *kubernetes.Clientset
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+
+	// the holder and renew time of the lease seen last, and when it is seen by the local clock
+	observedHolder    string
+	observedRenewTime time.Time
+	observedTime      time.Time
+}
+
+func NewLeaderElector(client *kubernetes.Clientset, namespace, name, identity string, leaseDuration, renewDeadline, retryPeriod time.Duration) (*LeaderElector, error) {
+	if leaseDuration <= renewDeadline {
+		return nil, fmt.Errorf("leaseDuration %v must be greater than renewDeadline %v", leaseDuration, renewDeadline)
+	}
+	if renewDeadline <= retryPeriod {
+		return nil, fmt.Errorf("renewDeadline %v must be greater than retryPeriod %v", renewDeadline, retryPeriod)
+	}
+	if identity == "" {
+		return nil, fmt.Errorf("identity is empty")
+	}
+	return &LeaderElector{
+		client:        client,
+		namespace:     namespace,
+		name:          name,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		renewDeadline: renewDeadline,
+		retryPeriod:   retryPeriod,
+	}, nil
+}
+
+// Run campaigns until stop is closed. run is called when this replica becomes the leader,
+// the channel passed to it is closed when the leadership is lost, and the next campaign
+// starts after run returns. The lease is released when stop is closed.
+func (le *LeaderElector) Run(stop <-chan struct{}, run func(leaderStop <-chan struct{})) {
+	for {
+		if !le.acquire(stop) {
+			return
+		}
+		glog.Infof("%s became the leader of lease %s/%s", le.identity, le.namespace, le.name)
+		leaderStop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			run(leaderStop)
+		}()
+		le.renew(stop)
+		close(leaderStop)
+		<-done
+		select {
+		case <-stop:
+			if err := le.release(); err != nil {
+				glog.Errorf("release lease %s/%s err:%v", le.namespace, le.name, err)
+			}
+			return
+		default:
+			glog.Warningf("%s lost the leadership of lease %s/%s", le.identity, le.namespace, le.name)
+		}
+	}
+}
+
+// acquire tries to get the lease every retryPeriod, it returns false if stop is closed
+func (le *LeaderElector) acquire(stop <-chan struct{}) bool {
+	for {
+		if le.tryAcquireOrRenew() {
+			return true
+		}
+		select {
+		case <-stop:
+			return false
+		case <-time.After(wait.Jitter(le.retryPeriod, 1.2)):
+		}
+	}
+}
+
+// renew renews the lease every retryPeriod until it fails for renewDeadline, another replica
+// takes it or stop is closed
+func (le *LeaderElector) renew(stop <-chan struct{}) {
+	lastRenew := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(le.retryPeriod):
+		}
+		if le.tryAcquireOrRenew() {
+			lastRenew = time.Now()
+		} else if le.observedHolder != le.identity || time.Since(lastRenew) > le.renewDeadline {
+			return
+		}
+	}
+}
+
+func (le *LeaderElector) observe(lease *coordinationv1beta1.Lease) {
+	holder := ""
+	if lease.Spec.HolderIdentity != nil {
+		holder = *lease.Spec.HolderIdentity
+	}
+	var renewTime time.Time
+	if lease.Spec.RenewTime != nil {
+		renewTime = lease.Spec.RenewTime.Time
+	}
+	if holder != le.observedHolder || !renewTime.Equal(le.observedRenewTime) {
+		le.observedHolder = holder
+		le.observedRenewTime = renewTime
+		le.observedTime = time.Now()
+	}
+}
+
+// tryAcquireOrRenew takes the lease if it is free or expired, or renews it if this replica holds it.
+// The expiration is measured by the local clock from when the last change of the lease was seen,
+// so the clocks of the replicas need not be synchronized.
+func (le *LeaderElector) tryAcquireOrRenew() bool {
+	leases := le.client.CoordinationV1beta1().Leases(le.namespace)
+	now := metav1.NewMicroTime(time.Now())
+	durationSeconds := int32(le.leaseDuration / time.Second)
+	lease, err := leases.Get(le.name, metav1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			glog.Errorf("get lease %s/%s err:%v", le.namespace, le.name, err)
+			return false
+		}
+		transitions := int32(0)
+		lease = &coordinationv1beta1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: le.name, Namespace: le.namespace},
+			Spec: coordinationv1beta1.LeaseSpec{
+				HolderIdentity:       &le.identity,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+				LeaseTransitions:     &transitions,
+			},
+		}
+		created, err := leases.Create(lease)
+		if err != nil {
+			glog.Errorf("create lease %s/%s err:%v", le.namespace, le.name, err)
+			return false
+		}
+		le.observe(created)
+		return true
+	}
+	le.observe(lease)
+	if le.observedHolder != "" && le.observedHolder != le.identity &&
+		le.observedTime.Add(le.getLeaseDuration(lease)).After(time.Now()) {
+		glog.V(4).Infof("lease %s/%s is held by %s", le.namespace, le.name, le.observedHolder)
+		return false
+	}
+	if le.observedHolder != le.identity {
+		transitions := int32(0)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		lease.Spec.LeaseTransitions = &transitions
+		lease.Spec.AcquireTime = &now
+	}
+	lease.Spec.HolderIdentity = &le.identity
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	lease.Spec.RenewTime = &now
+	updated, err := leases.Update(lease)
+	if err != nil {
+		glog.Errorf("update lease %s/%s err:%v", le.namespace, le.name, err)
+		return false
+	}
+	le.observe(updated)
+	return true
+}
+
+func (le *LeaderElector) getLeaseDuration(lease *coordinationv1beta1.Lease) time.Duration {
+	if lease.Spec.LeaseDurationSeconds != nil {
+		return time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+	return le.leaseDuration
+}
+
+// release gives up the lease so that another replica can take it without waiting for it to expire
+func (le *LeaderElector) release() error {
+	leases := le.client.CoordinationV1beta1().Leases(le.namespace)
+	lease, err := leases.Get(le.name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != le.identity {
+		return nil
+	}
+	holder, durationSeconds := "", int32(1)
+	now := metav1.NewMicroTime(time.Now())
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(lease)
+	return err
+}
@@ -29,7 +29,10 @@ import (
 	"github.com/Rhealb/admission-controller/pkg/common"
 
 	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/wait"
 	kube_flag "k8s.io/apiserver/pkg/util/flag"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
 )
 
 var (
@@ -41,8 +44,22 @@ var (
 	serverUrl           = flag.String("serverurl", "", "The server url of this controller.")
 	registConfigAuto    = flag.Bool("auto-regist-config", true, "Need regist hook config automatically")
 	csiDriverName       = flag.String("csi-driver-name", "xfshostpathplugin", "The csi hostpathpv driver name.")
+	driverRulesFile     = flag.String("driver-rules-file", "", "The yaml or json file of the rules choosing the csi driver of the converted pvs, all pvs are converted to --csi-driver-name if it is not set")
+	checkDriver         = flag.Bool("csi-driver-check", false, "Refuse to convert the pvs whose csi driver has no CSIDriver object or is not registered in the CSINodes of their nodes")
+	csiAPIVersion       = flag.String("csi-api-version", "storage.k8s.io/v1beta1", "The group version of the CSIDriver and CSINode objects, csi.storage.k8s.io/v1alpha1 for the alpha crds of kubernetes 1.13")
+	csiFSType           = flag.String("csi-fstype", "xfs", "The fsType of the converted csi hostpath pvs.")
 	updateOldHostpathPV = flag.Bool("update-hostpathpv-csi", false, "The update these hostpathpv to csi hostpathpv.")
 	updatePVInterVal    = flag.Duration("update-hostpathpv-csi-interval", 1*time.Hour, "update intervals between two hostpathpv")
+	journalNamespace    = flag.String("journal-namespace", "k8splugin", "The namespace of the ConfigMaps saving the journals of the hostpathpv updates")
+	migrationPlans      = flag.Bool("migration-plans", false, "Only update the hostpathpvs selected by the MigrationPlan objects, --update-hostpathpv-csi-interval is replaced by the interval of the plans")
+	handleTemplate      = flag.String("volume-handle-template", "", "The go template of the csi volume handles of the converted pvs, such as csi-xfshostpath-{{.Namespace}}-{{.Name}}, fields: Name, Namespace, ClaimName, ClusterID, UID. The md5 of the pv is used if it is empty")
+	clusterID           = flag.String("cluster-id", "", "The cluster id used by the volume handle template")
+	leaderElect         = flag.Bool("leader-elect", true, "Only run the hostpathpv updates on the replica holding the lease, the web hook is served by all replicas")
+	leaseNamespace      = flag.String("leader-elect-namespace", "k8splugin", "The namespace of the leader election lease")
+	leaseName           = flag.String("leader-elect-name", "hppvtocsipv-update-manager", "The name of the leader election lease")
+	leaseDuration       = flag.Duration("leader-elect-lease-duration", 15*time.Second, "The duration that the other replicas wait before taking the lease after the leader stopped renewing it")
+	renewDeadline       = flag.Duration("leader-elect-renew-deadline", 10*time.Second, "The duration that the leader retries renewing the lease before giving up the leadership")
+	retryPeriod         = flag.Duration("leader-elect-retry-period", 2*time.Second, "The duration between two tries of acquiring or renewing the lease")
 	upgradeImage        = flag.String("upgradeimage", "127.0.0.1:29006/library/busybox:1.25", "Image create to change quota dir type")
 )
 
@@ -58,7 +75,33 @@ func main() {
 	certs := common.InitCerts(*certsDir)
 	clientset := common.GetClient()
 
-	as := NewAdmissionServer(clientset, *csiDriverName)
+	drivers := NewDefaultDriverRules(*csiDriverName)
+	if *driverRulesFile != "" {
+		var err error
+		if drivers, err = LoadDriverRules(*driverRulesFile, *csiDriverName); err != nil {
+			glog.Fatalf("load driver rules err:%v", err)
+		}
+	}
+	var checker *DriverChecker
+	if *checkDriver {
+		checker = NewDriverChecker(clientset, *csiAPIVersion)
+	}
+
+	sharedInformers := informers.NewSharedInformerFactory(clientset, 0)
+	pvInformer := sharedInformers.Core().V1().PersistentVolumes()
+	nodeInformer := sharedInformers.Core().V1().Nodes()
+	pvSynced := pvInformer.Informer().HasSynced
+	nodeSynced := nodeInformer.Informer().HasSynced
+	handles, err := NewVolumeHandleGenerator(*handleTemplate, *clusterID, pvInformer.Lister())
+	if err != nil {
+		glog.Fatalf("create volume handle generator err:%v", err)
+	}
+	stopEverything := make(chan struct{})
+	sharedInformers.Start(stopEverything)
+	if !cache.WaitForCacheSync(wait.NeverStop, pvSynced, nodeSynced) {
+		glog.Fatalf("timed out waiting for pv or node caches to sync")
+	}
+	as := NewAdmissionServer(clientset, drivers, nodeInformer.Lister(), checker, *csiFSType, handles)
 
 	var sm http.ServeMux
 	sm.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -78,14 +121,35 @@ func main() {
 	}
 	if *updateOldHostpathPV == true {
 		glog.Infof("NewPVUpdateManager updatePVInterVal:%v", *updatePVInterVal)
-		updateManager := NewPVUpdateManager(clientset, *updatePVInterVal, *upgradeImage)
-		updateManager.Start()
+		// a new manager is started in every term of the leadership
+		runUpdateManager := func(stop <-chan struct{}) {
+			updateManager := NewPVUpdateManager(clientset, as, *updatePVInterVal, *upgradeImage, *migrationPlans, *journalNamespace)
+			if err := updateManager.Start(); err != nil {
+				glog.Errorf("start PVUpdateManager err:%v", err)
+			}
+			<-stop
+			updateManager.Stop()
+		}
+		stopUpdate := make(chan struct{})
+		if *leaderElect {
+			identity, err := os.Hostname()
+			if err != nil {
+				glog.Fatalf("get hostname err:%v", err)
+			}
+			elector, err := NewLeaderElector(clientset, *leaseNamespace, *leaseName, identity, *leaseDuration, *renewDeadline, *retryPeriod)
+			if err != nil {
+				glog.Fatalf("create leader elector err:%v", err)
+			}
+			go elector.Run(stopUpdate, runUpdateManager)
+		} else {
+			go runUpdateManager(stopUpdate)
+		}
 
-		signalChan := make(chan os.Signal)
+		signalChan := make(chan os.Signal, 1)
 		go func() {
 			select {
 			case <-signalChan:
-				updateManager.Stop()
+				close(stopUpdate)
 				break
 			}
 		}()
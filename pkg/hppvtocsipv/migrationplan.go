@@ -0,0 +1,221 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// migrationPlanPath is the api path of the cluster scoped MigrationPlan crd (deploy/hppvtocsipv-migrationplan-crd.yaml)
+	migrationPlanPath = "/apis/hppvtocsipv.enndata.cn/v1alpha1/migrationplans"
+
+	// the phases of the MigrationPlans
+	planPhaseRunning   = "Running"
+	planPhasePaused    = "Paused"
+	planPhaseWaiting   = "WaitingForWindow"
+	planPhaseCompleted = "Completed"
+
+	// the phases of the pvs of the MigrationPlans
+	pvPhasePending   = "Pending"
+	pvPhaseRunning   = "Running"
+	pvPhaseSucceeded = "Succeeded"
+	pvPhaseFailed    = "Failed"
+	pvPhaseSkipped   = "Skipped"
+)
+
+// MigrationPlan describes the migration of the hostpath pvs selected by it to csi pvs
+type MigrationPlan struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              MigrationPlanSpec   `json:"spec"`
+	Status            MigrationPlanStatus `json:"status,omitempty"`
+}
+
+type MigrationPlanSpec struct {
+	// PVSelector selects the hostpath pvs to migrate, all hostpath pvs are selected if it is not set
+	PVSelector *metav1.LabelSelector `json:"pvSelector,omitempty"`
+	// Concurrency is the max number of the pvs migrated at the same time, default 1
+	Concurrency int `json:"concurrency,omitempty"`
+	// Interval is the min time between starting two migrations, such as 10m
+	Interval string `json:"interval,omitempty"`
+	// MaxAttempts is the max number of the migrations of a failed pv, default 1
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// MaintenanceWindow limits when the migrations are started, they can start any time if it is not set
+	MaintenanceWindow *MaintenanceWindow `json:"maintenanceWindow,omitempty"`
+	// Paused stops starting new migrations, the running ones are finished
+	Paused bool `json:"paused,omitempty"`
+}
+
+// MaintenanceWindow is a daily window such as 22:00-06:00
+type MaintenanceWindow struct {
+	// Start and End are HH:MM, the window crosses midnight if End is not after Start
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// TimeZone is the location of Start and End such as Asia/Shanghai, default UTC
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+type MigrationPlanStatus struct {
+	Phase          string              `json:"phase,omitempty"`
+	Message        string              `json:"message,omitempty"`
+	PVs            []PVMigrationStatus `json:"pvs,omitempty"`
+	LastUpdateTime *metav1.Time        `json:"lastUpdateTime,omitempty"`
+}
+
+// PVMigrationStatus is the migration status of a pv of the plan
+type PVMigrationStatus struct {
+	Name  string `json:"name"`
+	Phase string `json:"phase"`
+	// Step is the current (or the last) step of the UpdatePipeline
+	Step           string       `json:"step,omitempty"`
+	Error          string       `json:"error,omitempty"`
+	Attempts       int          `json:"attempts,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+type migrationPlanList struct {
+	Items []MigrationPlan `json:"items"`
+}
+
+func (spec *MigrationPlanSpec) getConcurrency() int {
+	if spec.Concurrency <= 0 {
+		return 1
+	}
+	return spec.Concurrency
+}
+
+func (spec *MigrationPlanSpec) getMaxAttempts() int {
+	if spec.MaxAttempts <= 0 {
+		return 1
+	}
+	return spec.MaxAttempts
+}
+
+func (spec *MigrationPlanSpec) getInterval() (time.Duration, error) {
+	if spec.Interval == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(spec.Interval)
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, should be HH:MM", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// inWindow returns whether now is in the maintenance window
+func (w *MaintenanceWindow) inWindow(now time.Time) (bool, error) {
+	if w == nil {
+		return true, nil
+	}
+	location := time.UTC
+	if w.TimeZone != "" {
+		var err error
+		if location, err = time.LoadLocation(w.TimeZone); err != nil {
+			return false, fmt.Errorf("invalid timeZone %q: %v", w.TimeZone, err)
+		}
+	}
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return false, err
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return false, err
+	}
+	now = now.In(location)
+	clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	if start < end {
+		return clock >= start && clock < end, nil
+	}
+	return clock >= start || clock < end, nil
+}
+
+func (status *MigrationPlanStatus) getPV(name string) *PVMigrationStatus {
+	for i := range status.PVs {
+		if status.PVs[i].Name == name {
+			return &status.PVs[i]
+		}
+	}
+	return nil
+}
+
+// migrationPlanClient reads and writes the MigrationPlans through the raw api paths
+type migrationPlanClient struct {
+	client *kubernetes.Clientset
+}
+
+func (c *migrationPlanClient) list() ([]MigrationPlan, error) {
+	buf, err := c.client.CoreV1().RESTClient().Get().AbsPath(migrationPlanPath).Do().Raw()
+	if err != nil {
+		return nil, err
+	}
+	list := migrationPlanList{}
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return nil, fmt.Errorf("decode MigrationPlans err:%v", err)
+	}
+	return list.Items, nil
+}
+
+func (c *migrationPlanClient) get(name string) (*MigrationPlan, error) {
+	buf, err := c.client.CoreV1().RESTClient().Get().AbsPath(migrationPlanPath, name).Do().Raw()
+	if err != nil {
+		return nil, err
+	}
+	plan := &MigrationPlan{}
+	if err := json.Unmarshal(buf, plan); err != nil {
+		return nil, fmt.Errorf("decode MigrationPlan %s err:%v", name, err)
+	}
+	return plan, nil
+}
+
+func (c *migrationPlanClient) updateStatus(plan *MigrationPlan) error {
+	now := metav1.Now()
+	plan.Status.LastUpdateTime = &now
+	buf, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	return c.client.CoreV1().RESTClient().Put().AbsPath(migrationPlanPath, plan.Name, "status").
+		SetHeader("Content-Type", "application/json").Body(buf).Do().Error()
+}
+
+// modifyStatus applies modify to the status of the latest plan name, it is retried on conflicts
+func (c *migrationPlanClient) modifyStatus(name string, modify func(plan *MigrationPlan)) error {
+	var err error
+	for i := 0; i < 5; i++ {
+		var plan *MigrationPlan
+		if plan, err = c.get(name); err != nil {
+			return err
+		}
+		modify(plan)
+		if err = c.updateStatus(plan); err == nil || errors.IsConflict(err) == false {
+			return err
+		}
+	}
+	return err
+}
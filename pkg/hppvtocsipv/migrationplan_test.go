@@ -0,0 +1,65 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInWindow(t *testing.T) {
+	at := func(clock string) time.Time {
+		now, err := time.Parse(time.RFC3339, "2019-01-01T"+clock+":00Z")
+		if err != nil {
+			t.Fatalf("parse %s err:%v", clock, err)
+		}
+		return now
+	}
+	tests := []struct {
+		name    string
+		window  *MaintenanceWindow
+		now     time.Time
+		want    bool
+		wantErr bool
+	}{
+		{name: "no window", window: nil, now: at("12:00"), want: true},
+		{name: "same day inside", window: &MaintenanceWindow{Start: "01:00", End: "05:00"}, now: at("03:00"), want: true},
+		{name: "same day at start", window: &MaintenanceWindow{Start: "01:00", End: "05:00"}, now: at("01:00"), want: true},
+		{name: "same day at end", window: &MaintenanceWindow{Start: "01:00", End: "05:00"}, now: at("05:00"), want: false},
+		{name: "same day before", window: &MaintenanceWindow{Start: "01:00", End: "05:00"}, now: at("00:59"), want: false},
+		{name: "same day after", window: &MaintenanceWindow{Start: "01:00", End: "05:00"}, now: at("12:00"), want: false},
+		{name: "crossing midnight before midnight", window: &MaintenanceWindow{Start: "22:00", End: "02:00"}, now: at("23:30"), want: true},
+		{name: "crossing midnight after midnight", window: &MaintenanceWindow{Start: "22:00", End: "02:00"}, now: at("01:59"), want: true},
+		{name: "crossing midnight at end", window: &MaintenanceWindow{Start: "22:00", End: "02:00"}, now: at("02:00"), want: false},
+		{name: "crossing midnight outside", window: &MaintenanceWindow{Start: "22:00", End: "02:00"}, now: at("12:00"), want: false},
+		{name: "whole day", window: &MaintenanceWindow{Start: "00:00", End: "00:00"}, now: at("12:00"), want: true},
+		{name: "time zone inside", window: &MaintenanceWindow{Start: "01:00", End: "05:00", TimeZone: "Asia/Shanghai"}, now: at("19:00"), want: true},
+		{name: "time zone outside", window: &MaintenanceWindow{Start: "01:00", End: "05:00", TimeZone: "Asia/Shanghai"}, now: at("03:00"), want: false},
+		{name: "invalid time zone", window: &MaintenanceWindow{Start: "01:00", End: "05:00", TimeZone: "Nowhere/Nowhere"}, now: at("03:00"), wantErr: true},
+		{name: "invalid start", window: &MaintenanceWindow{Start: "1am", End: "05:00"}, now: at("03:00"), wantErr: true},
+		{name: "invalid end", window: &MaintenanceWindow{Start: "01:00", End: "25:00"}, now: at("03:00"), wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := test.window.inWindow(test.now)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected err:%v", test.name, err)
+			continue
+		}
+		if err == nil && got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+const planSyncPeriod = 10 * time.Second
+
+func (pvum *PVUpdateManager) isPVRunning(pvName string) bool {
+	pvum.mu.Lock()
+	defer pvum.mu.Unlock()
+	_, exist := pvum.runningPVs[pvName]
+	return exist
+}
+
+func (pvum *PVUpdateManager) setPVRunning(pvName, planName string, running bool) {
+	pvum.mu.Lock()
+	defer pvum.mu.Unlock()
+	if running {
+		pvum.runningPVs[pvName] = planName
+	} else {
+		delete(pvum.runningPVs, pvName)
+	}
+}
+
+// getSelectedHostPathPVs returns the hostpath pvs selected by the plan
+func getSelectedHostPathPVs(plan *MigrationPlan, pvLister corelisters.PersistentVolumeLister) (map[string]*v1.PersistentVolume, error) {
+	selector := labels.Everything()
+	if plan.Spec.PVSelector != nil {
+		var err error
+		if selector, err = metav1.LabelSelectorAsSelector(plan.Spec.PVSelector); err != nil {
+			return nil, fmt.Errorf("invalid pvSelector: %v", err)
+		}
+	}
+	pvs, err := pvLister.List(selector)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]*v1.PersistentVolume)
+	for _, pv := range pvs {
+		if pv.Spec.HostPath != nil && isPVShouldBeIgnored(pv) == false {
+			ret[pv.Name] = pv
+		}
+	}
+	return ret, nil
+}
+
+// syncPlans adds the selected pvs to the status of every plan and starts their migrations
+func (pvum *PVUpdateManager) syncPlans() {
+	plans, err := pvum.plans.list()
+	if err != nil {
+		glog.Errorf("list MigrationPlans err:%v", err)
+		return
+	}
+	for i := range plans {
+		if err := pvum.syncPlan(&plans[i]); err != nil {
+			glog.Errorf("sync MigrationPlan %s err:%v", plans[i].Name, err)
+		}
+	}
+}
+
+func (pvum *PVUpdateManager) syncPlan(plan *MigrationPlan) error {
+	pvs, errSelect := getSelectedHostPathPVs(plan, pvum.pvLister)
+	if errSelect != nil && pvs == nil {
+		pvs = map[string]*v1.PersistentVolume{}
+	}
+	names := make([]string, 0, len(pvs))
+	for name := range pvs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	interval, errInterval := plan.Spec.getInterval()
+	inWindow, errWindow := plan.Spec.MaintenanceWindow.inWindow(time.Now())
+
+	planErr := firstError(errSelect, errInterval, errWindow)
+	now := time.Now()
+
+	var toStart []string
+	err := pvum.plans.modifyStatus(plan.Name, func(p *MigrationPlan) {
+		toStart = schedulePlan(p, names, pvs, pvum.isPVRunning, planErr, inWindow, interval, pvum.lastStart[p.Name], now)
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range toStart {
+		pvum.lastStart[plan.Name] = time.Now()
+		pvum.runPlanPV(plan.Name, pvs[name])
+	}
+	return nil
+}
+
+// schedulePlan updates the status of the plan p whose selected hostpath pvs are pvs (names are sorted),
+// and returns the pvs to start migrating now. planErr pauses the plan, isPVRunning tells whether a pv
+// is being migrated by this manager and lastStart is the time the last migration of the plan started.
+func schedulePlan(p *MigrationPlan, names []string, pvs map[string]*v1.PersistentVolume, isPVRunning func(pvName string) bool,
+	planErr error, inWindow bool, interval time.Duration, lastStart, now time.Time) []string {
+	toStart := []string{}
+	status := &p.Status
+	for _, name := range names {
+		if status.getPV(name) == nil {
+			status.PVs = append(status.PVs, PVMigrationStatus{Name: name, Phase: pvPhasePending})
+		}
+	}
+	running, remaining := 0, 0
+	maxAttempts := p.Spec.getMaxAttempts()
+	for i := range status.PVs {
+		s := &status.PVs[i]
+		if s.Phase == pvPhaseRunning && isPVRunning(s.Name) == false {
+			s.Phase = pvPhasePending
+			s.Error = "the migration was interrupted"
+		}
+		retry := s.Phase == pvPhaseFailed && s.Attempts < maxAttempts
+		if (s.Phase == pvPhasePending || retry) && pvs[s.Name] == nil {
+			s.Phase = pvPhaseSkipped
+			s.Error = "pv is not a hostpath pv selected by the plan any more"
+			retry = false
+		}
+		switch {
+		case s.Phase == pvPhaseRunning:
+			running++
+		case s.Phase == pvPhasePending || retry:
+			remaining++
+		}
+	}
+
+	status.Message = ""
+	switch {
+	case planErr != nil:
+		status.Phase = planPhasePaused
+		status.Message = fmt.Sprintf("invalid plan: %v", planErr)
+		return toStart
+	case running == 0 && remaining == 0:
+		status.Phase = planPhaseCompleted
+		return toStart
+	case p.Spec.Paused:
+		status.Phase = planPhasePaused
+		return toStart
+	case inWindow == false:
+		status.Phase = planPhaseWaiting
+		return toStart
+	}
+	status.Phase = planPhaseRunning
+	if interval > 0 && now.Sub(lastStart) < interval {
+		return toStart
+	}
+	startTime := metav1.NewTime(now)
+	for i := range status.PVs {
+		if running+len(toStart) >= p.Spec.getConcurrency() || (interval > 0 && len(toStart) > 0) {
+			break
+		}
+		s := &status.PVs[i]
+		if s.Phase != pvPhasePending && (s.Phase != pvPhaseFailed || s.Attempts >= maxAttempts) {
+			continue
+		}
+		if isPVRunning(s.Name) {
+			// the pv is being migrated by another plan
+			continue
+		}
+		s.Phase = pvPhaseRunning
+		s.Attempts++
+		s.Step = ""
+		s.Error = ""
+		s.StartTime = &startTime
+		s.CompletionTime = nil
+		toStart = append(toStart, s.Name)
+	}
+	return toStart
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// modifyPVStatus applies modify to the status of pv in the plan
+func (pvum *PVUpdateManager) modifyPVStatus(planName, pvName string, modify func(s *PVMigrationStatus)) {
+	err := pvum.plans.modifyStatus(planName, func(plan *MigrationPlan) {
+		if s := plan.Status.getPV(pvName); s != nil {
+			modify(s)
+		}
+	})
+	if err != nil {
+		glog.Errorf("update status of pv %s in MigrationPlan %s err:%v", pvName, planName, err)
+	}
+}
+
+// runPlanPV migrates pv in background and records its steps and result in the status of the plan
+func (pvum *PVUpdateManager) runPlanPV(planName string, pv *v1.PersistentVolume) {
+	pvum.setPVRunning(pv.Name, planName, true)
+	pipeline := pvum.createPVUpdatePipeline(pvum.client, pv.Name, pvum.upgradeImage, pv.Status.Phase == v1.VolumeBound, pvum.stopCh)
+	pipeline.plan = planName
+	pipeline.onStep = func(step string) {
+		pvum.modifyPVStatus(planName, pv.Name, func(s *PVMigrationStatus) {
+			s.Step = step
+		})
+	}
+	pvum.wg.Add(1)
+	go func() {
+		defer pvum.wg.Done()
+		defer pvum.setPVRunning(pv.Name, planName, false)
+		go pipeline.Run()
+		err := <-pipeline.Done()
+		if pipeline.abandoned {
+			// the status is updated by the next leader when it recovers the pipeline
+			return
+		}
+		pvum.modifyPVStatus(planName, pv.Name, func(s *PVMigrationStatus) {
+			now := metav1.Now()
+			s.CompletionTime = &now
+			switch {
+			case err != nil:
+				s.Phase = pvPhaseFailed
+				s.Error = err.Error()
+			case pipeline.completed == false:
+				s.Phase = pvPhasePending
+				s.Error = "pv is being migrated by another pipeline"
+			default:
+				s.Phase = pvPhaseSucceeded
+			}
+		})
+		if err != nil {
+			glog.Errorf("MigrationPlan %s update pv %s to csi err:%v", planName, pv.Name, err)
+		}
+	}()
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestSchedulePlan(t *testing.T) {
+	now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	type pvStatus struct {
+		phase    string
+		attempts int
+	}
+	tests := []struct {
+		name        string
+		spec        MigrationPlanSpec
+		selected    []string
+		status      map[string]pvStatus
+		running     []string
+		planErr     error
+		notInWindow bool
+		interval    time.Duration
+		lastStart   time.Time
+		wantPhase   string
+		wantStart   []string
+		wantStatus  map[string]pvStatus
+	}{
+		{
+			name:       "new pvs start in name order",
+			selected:   []string{"pv2", "pv1"},
+			wantPhase:  planPhaseRunning,
+			wantStart:  []string{"pv1"},
+			wantStatus: map[string]pvStatus{"pv1": {pvPhaseRunning, 1}, "pv2": {pvPhasePending, 0}},
+		},
+		{
+			name:       "concurrency",
+			spec:       MigrationPlanSpec{Concurrency: 2},
+			selected:   []string{"pv1", "pv2", "pv3"},
+			wantPhase:  planPhaseRunning,
+			wantStart:  []string{"pv1", "pv2"},
+			wantStatus: map[string]pvStatus{"pv1": {pvPhaseRunning, 1}, "pv2": {pvPhaseRunning, 1}, "pv3": {pvPhasePending, 0}},
+		},
+		{
+			name:       "running pvs count in concurrency",
+			spec:       MigrationPlanSpec{Concurrency: 2},
+			selected:   []string{"pv1", "pv2", "pv3"},
+			status:     map[string]pvStatus{"pv1": {pvPhaseRunning, 1}},
+			running:    []string{"pv1"},
+			wantPhase:  planPhaseRunning,
+			wantStart:  []string{"pv2"},
+			wantStatus: map[string]pvStatus{"pv1": {pvPhaseRunning, 1}, "pv2": {pvPhaseRunning, 1}, "pv3": {pvPhasePending, 0}},
+		},
+		{
+			name:       "pv running in another plan is skipped",
+			selected:   []string{"pv1", "pv2"},
+			running:    []string{"pv1"},
+			wantPhase:  planPhaseRunning,
+			wantStart:  []string{"pv2"},
+			wantStatus: map[string]pvStatus{"pv1": {pvPhasePending, 0}, "pv2": {pvPhaseRunning, 1}},
+		},
+		{
+			name:       "interrupted pv is restarted",
+			selected:   []string{"pv1"},
+			spec:       MigrationPlanSpec{MaxAttempts: 2},
+			status:     map[string]pvStatus{"pv1": {pvPhaseRunning, 1}},
+			wantPhase:  planPhaseRunning,
+			wantStart:  []string{"pv1"},
+			wantStatus: map[string]pvStatus{"pv1": {pvPhaseRunning, 2}},
+		},
+		{
+			name:       "failed pv is retried",
+			spec:       MigrationPlanSpec{MaxAttempts: 3},
+			selected:   []string{"pv1"},
+			status:     map[string]pvStatus{"pv1": {pvPhaseFailed, 2}},
+			wantPhase:  planPhaseRunning,
+			wantStart:  []string{"pv1"},
+			wantStatus: map[string]pvStatus{"pv1": {pvPhaseRunning, 3}},
+		},
+		{
+			name:       "failed pv is not retried after max attempts",
+			spec:       MigrationPlanSpec{MaxAttempts: 3},
+			selected:   []string{"pv1", "pv2"},
+			status:     map[string]pvStatus{"pv1": {pvPhaseFailed, 3}, "pv2": {pvPhaseSucceeded, 1}},
+			wantPhase:  planPhaseCompleted,
+			wantStatus: map[string]pvStatus{"pv1": {pvPhaseFailed, 3}, "pv2": {pvPhaseSucceeded, 1}},
+		},
+		{
+			name:       "failed pv is not retried by default",
+			selected:   []string{"pv1"},
+			status:     map[string]pvStatus{"pv1": {pvPhaseFailed, 1}},
+			wantPhase:  planPhaseCompleted,
+			wantStatus: map[string]pvStatus{"pv1": {pvPhaseFailed, 1}},
+		},
+		{
+			name:       "unselected pvs are skipped",
+			spec:       MigrationPlanSpec{MaxAttempts: 2},
+			selected:   []string{},
+			status:     map[string]pvStatus{"pv1": {pvPhasePending, 0}, "pv2": {pvPhaseFailed, 1}, "pv3": {pvPhaseSucceeded, 1}},
+			wantPhase:  planPhaseCompleted,
+			wantStatus: map[string]pvStatus{"pv1": {pvPhaseSkipped, 0}, "pv2": {pvPhaseSkipped, 1}, "pv3": {pvPhaseSucceeded, 1}},
+		},
+		{
+			name:       "invalid plan",
+			selected:   []string{"pv1"},
+			planErr:    fmt.Errorf("invalid interval"),
+			wantPhase:  planPhasePaused,
+			wantStatus: map[string]pvStatus{"pv1": {pvPhasePending, 0}},
+		},
+		{
+			name:       "paused",
+			spec:       MigrationPlanSpec{Paused: true},
+			selected:   []string{"pv1"},
+			wantPhase:  planPhasePaused,
+			wantStatus: map[string]pvStatus{"pv1": {pvPhasePending, 0}},
+		},
+		{
+			name:        "not in window",
+			selected:    []string{"pv1"},
+			notInWindow: true,
+			wantPhase:   planPhaseWaiting,
+			wantStatus:  map[string]pvStatus{"pv1": {pvPhasePending, 0}},
+		},
+		{
+			name:        "completed out of window",
+			selected:    []string{"pv1"},
+			status:      map[string]pvStatus{"pv1": {pvPhaseSucceeded, 1}},
+			notInWindow: true,
+			wantPhase:   planPhaseCompleted,
+			wantStatus:  map[string]pvStatus{"pv1": {pvPhaseSucceeded, 1}},
+		},
+		{
+			name:       "interval not passed",
+			spec:       MigrationPlanSpec{Concurrency: 3},
+			selected:   []string{"pv1", "pv2"},
+			interval:   10 * time.Minute,
+			lastStart:  now.Add(-5 * time.Minute),
+			wantPhase:  planPhaseRunning,
+			wantStatus: map[string]pvStatus{"pv1": {pvPhasePending, 0}, "pv2": {pvPhasePending, 0}},
+		},
+		{
+			name:       "interval passed starts one pv",
+			spec:       MigrationPlanSpec{Concurrency: 3},
+			selected:   []string{"pv1", "pv2"},
+			interval:   10 * time.Minute,
+			lastStart:  now.Add(-10 * time.Minute),
+			wantPhase:  planPhaseRunning,
+			wantStart:  []string{"pv1"},
+			wantStatus: map[string]pvStatus{"pv1": {pvPhaseRunning, 1}, "pv2": {pvPhasePending, 0}},
+		},
+	}
+	for _, test := range tests {
+		plan := &MigrationPlan{Spec: test.spec}
+		for name, s := range test.status {
+			plan.Status.PVs = append(plan.Status.PVs, PVMigrationStatus{Name: name, Phase: s.phase, Attempts: s.attempts})
+		}
+		sort.Slice(plan.Status.PVs, func(i, j int) bool { return plan.Status.PVs[i].Name < plan.Status.PVs[j].Name })
+		pvs := map[string]*v1.PersistentVolume{}
+		for _, name := range test.selected {
+			pvs[name] = &v1.PersistentVolume{}
+		}
+		names := append([]string{}, test.selected...)
+		sort.Strings(names)
+		running := map[string]bool{}
+		for _, name := range test.running {
+			running[name] = true
+		}
+		isPVRunning := func(pvName string) bool { return running[pvName] }
+
+		toStart := schedulePlan(plan, names, pvs, isPVRunning, test.planErr, test.notInWindow == false, test.interval, test.lastStart, now)
+		if len(toStart) != 0 || len(test.wantStart) != 0 {
+			if reflect.DeepEqual(toStart, test.wantStart) == false {
+				t.Errorf("%s: got started pvs %v, want %v", test.name, toStart, test.wantStart)
+			}
+		}
+		if plan.Status.Phase != test.wantPhase {
+			t.Errorf("%s: got phase %s, want %s", test.name, plan.Status.Phase, test.wantPhase)
+		}
+		for _, name := range toStart {
+			if s := plan.Status.getPV(name); s.StartTime == nil || s.StartTime.Time.Equal(now) == false {
+				t.Errorf("%s: pv %s has start time %v, want %v", test.name, name, s.StartTime, now)
+			}
+		}
+		status := map[string]pvStatus{}
+		for _, s := range plan.Status.PVs {
+			status[s.Name] = pvStatus{s.Phase, s.Attempts}
+		}
+		if reflect.DeepEqual(status, test.wantStatus) == false {
+			t.Errorf("%s: got pv status %v, want %v", test.name, status, test.wantStatus)
+		}
+	}
+}
@@ -16,24 +16,24 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"sort"
 
+	"github.com/Rhealb/admission-controller/pkg/common"
 	"github.com/Rhealb/admission-controller/pkg/utils/metrics"
 
 	"github.com/golang/glog"
-	"github.com/mattbaird/jsonpatch"
 	"k8s.io/api/admission/v1beta1"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 )
 
 const (
@@ -43,7 +43,12 @@ const (
 
 type AdmissionServer struct {
 	client     *kubernetes.Clientset
-	driverName string
+	drivers    *DriverRules
+	nodeLister corelisters.NodeLister
+	// checker is nil if the drivers are not checked
+	checker *DriverChecker
+	fsType  string
+	handles *VolumeHandleGenerator
 }
 
 //生成32位md5字串
@@ -59,10 +64,15 @@ func GetGuid(raw []byte) string {
 }
 
 // NewAdmissionServer constructs new AdmissionServer
-func NewAdmissionServer(client *kubernetes.Clientset, driverName string) *AdmissionServer {
+func NewAdmissionServer(client *kubernetes.Clientset, drivers *DriverRules, nodeLister corelisters.NodeLister,
+	checker *DriverChecker, fsType string, handles *VolumeHandleGenerator) *AdmissionServer {
 	return &AdmissionServer{
 		client:     client,
-		driverName: driverName,
+		drivers:    drivers,
+		nodeLister: nodeLister,
+		checker:    checker,
+		fsType:     fsType,
+		handles:    handles,
 	}
 }
 
@@ -89,14 +99,63 @@ func isPVShouldBeIgnored(pv *v1.PersistentVolume) bool {
 	return false
 }
 
-func changeHostpathPVToCSIPV(pv *v1.PersistentVolume, driverName, uid string) {
+// preserveHostPathPV keeps the capacity of pv and the nodes of its existing quota directories by node affinity
+func preserveHostPathPV(pv *v1.PersistentVolume) error {
+	if err := preserveCapacity(pv); err != nil {
+		return fmt.Errorf("get capacity of pv %s err:%v", pv.Name, err)
+	}
+	if pv.Spec.NodeAffinity == nil {
+		nodeAffinity, err := getMountNodeAffinity(pv)
+		if err != nil {
+			return fmt.Errorf("get mount info of pv %s err:%v", pv.Name, err)
+		}
+		pv.Spec.NodeAffinity = nodeAffinity
+	}
+	return nil
+}
+
+// changeHostpathPVToCSIPV replaces the hostpath source of pv by the csi source, the annotations are translated to volume attributes
+func changeHostpathPVToCSIPV(pv *v1.PersistentVolume, driverName, uid, fsType string) {
+	attributes := getVolumeAttributes(pv)
 	pv.Spec.HostPath = nil
 	pv.Spec.CSI = &v1.CSIPersistentVolumeSource{
-		Driver:       driverName,
-		VolumeHandle: uid,
+		Driver:           driverName,
+		VolumeHandle:     uid,
+		FSType:           fsType,
+		VolumeAttributes: attributes,
 	}
 }
 
+// convertHostPathPV converts the hostpath pv to a csi pv in place, it is used by both the web hook
+// and the UpdatePipeline. handle is used as the volume handle if it is not empty, otherwise it is
+// generated from pv and its json raw. The returned code is the http status of the error.
+func (s *AdmissionServer) convertHostPathPV(pv *v1.PersistentVolume, raw []byte, handle string) (int32, error) {
+	if err := preserveHostPathPV(pv); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	driver, ruleName, err := s.drivers.match(pv, s.nodeLister)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	glog.V(4).Infof("hostpath pv %s is converted to csi driver %s by rule %q", pv.Name, driver, ruleName)
+	if err := s.checker.Check(driver, getPVNodes(pv)); err != nil {
+		return http.StatusForbidden, fmt.Errorf("refuse to convert hostpath pv %s: %v", pv.Name, err)
+	}
+	uid := handle
+	if uid == "" {
+		if uid, err = s.handles.Generate(pv, raw); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	if owner, err := s.handles.GetHandleOwner(pv.Name, uid, driver); err != nil {
+		return http.StatusInternalServerError, err
+	} else if owner != "" {
+		return http.StatusConflict, fmt.Errorf("volume handle %s of pv %s is used by pv %s", uid, pv.Name, owner)
+	}
+	changeHostpathPVToCSIPV(pv, driver, uid, s.fsType)
+	return 0, nil
+}
+
 func allowAdmissionResponse() *v1beta1.AdmissionResponse {
 	return &v1beta1.AdmissionResponse{
 		Allowed: true,
@@ -119,7 +178,6 @@ func (s *AdmissionServer) admit(ar v1beta1.AdmissionReview) *v1beta1.AdmissionRe
 		glog.Error(err)
 		return toAdmissionResponse(err, http.StatusInternalServerError)
 	}
-	uid := GetGuid(ar.Request.Object.Raw)
 	newPV := pv.DeepCopy()
 
 	if ok, err := isHostpathPV(newPV); err != nil {
@@ -133,11 +191,13 @@ func (s *AdmissionServer) admit(ar v1beta1.AdmissionReview) *v1beta1.AdmissionRe
 		return allowAdmissionResponse()
 	}
 
-	changeHostpathPVToCSIPV(newPV, s.driverName, uid)
+	if code, err := s.convertHostPathPV(newPV, ar.Request.Object.Raw, ""); err != nil {
+		return toAdmissionResponse(err, code)
+	}
 
 	if newPVJson, err := json.Marshal(&newPV); err != nil {
 		return toAdmissionResponse(err, http.StatusInternalServerError)
-	} else if patch, errPath := createPatch(ar.Request.Object.Raw, newPVJson); errPath != nil {
+	} else if patch, errPath := common.CreatePatch(ar.Request.Object.Raw, newPVJson); errPath != nil {
 		return toAdmissionResponse(errPath, http.StatusInternalServerError)
 	} else {
 		var patchType = v1beta1.PatchTypeJSONPatch
@@ -199,26 +259,3 @@ func (s *AdmissionServer) Serve(w http.ResponseWriter, r *http.Request) {
 
 	timer.Observe(metrics.Applied, metrics.Pod)
 }
-
-func createPatch(oldPod, newPod []byte) ([]byte, error) {
-	patchOperations, err := jsonpatch.CreatePatch(oldPod, newPod)
-	if err != nil {
-		return nil, err
-	}
-	sort.Sort(jsonpatch.ByPath(patchOperations))
-	var b bytes.Buffer
-	b.WriteString("[")
-	l := len(patchOperations)
-	for i, patchOperation := range patchOperations {
-		buf, err := patchOperation.MarshalJSON()
-		if err != nil {
-			return nil, err
-		}
-		b.Write(buf)
-		if i < l-1 {
-			b.WriteString(",")
-		}
-	}
-	b.WriteString("]")
-	return b.Bytes(), nil
-}
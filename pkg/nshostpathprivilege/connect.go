@@ -0,0 +1,121 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+const connectPath = "/connect"
+
+var connectSubResources = map[string]bool{
+	"exec":        true,
+	"attach":      true,
+	"portforward": true,
+}
+
+// ConnectAdmissionServer checks exec, attach and portforward into the pods,
+// a user who can exec into a privileged pod has root on the node.
+type ConnectAdmissionServer struct {
+	client        *kubernetes.Clientset
+	podsLister    corelisters.PodLister
+	server        *AdmissionServer
+	allowedGroups map[string]struct{}
+}
+
+// NewConnectAdmissionServer constructs new ConnectAdmissionServer, only the users of
+// allowedGroups can connect to the privileged or hostpath pods. The hostpath pvs of the
+// pods are found by server.
+func NewConnectAdmissionServer(client *kubernetes.Clientset, podsLister corelisters.PodLister, server *AdmissionServer, allowedGroups []string) *ConnectAdmissionServer {
+	return &ConnectAdmissionServer{
+		client:        client,
+		podsLister:    podsLister,
+		server:        server,
+		allowedGroups: toStrMap(allowedGroups),
+	}
+}
+
+// getPod returns the pod from the cache, it is got from the apiserver if it is not in
+// the cache yet (such as a pod just created).
+func (s *ConnectAdmissionServer) getPod(namespace, name string) (*v1.Pod, error) {
+	pod, err := s.podsLister.Pods(namespace).Get(name)
+	if err == nil || errors.IsNotFound(err) == false {
+		return pod, err
+	}
+	return s.client.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
+}
+
+func (s *ConnectAdmissionServer) isUserAllowed(groups []string) bool {
+	for _, group := range groups {
+		if _, exist := s.allowedGroups[group]; exist {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ConnectAdmissionServer) admit(ctx context.Context, ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+	if ar.Request == nil || ar.Request.Resource != podResource || connectSubResources[ar.Request.SubResource] == false {
+		glog.Errorf("expect resource to be %s/exec, attach or portforward", podResource)
+		return nil
+	}
+	if ar.Request.Operation != v1beta1.Connect {
+		glog.Errorf("unexpect operation %s", ar.Request.Operation)
+		return nil
+	}
+
+	req := ar.Request
+	pod, err := s.getPod(req.Namespace, req.Name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return toAdmissionResponse(fmt.Errorf("pod %s:%s is not found", req.Namespace, req.Name), http.StatusForbidden)
+		}
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	}
+	hostPathPVs, err := s.server.getPodHostPathPVs(pod)
+	if err != nil {
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	}
+	var permission string
+	if isPodPrivilge(pod) {
+		permission = permissionPrivilege
+	} else if isPodUseHostPath(pod) || len(hostPathPVs) > 0 {
+		permission = permissionHostPath
+	} else {
+		return allowAdmissionResponse()
+	}
+	if s.isUserAllowed(req.UserInfo.Groups) {
+		glog.Infof("user %s %s pod %s:%s using %s", req.UserInfo.Username, req.SubResource, req.Namespace, req.Name, permission)
+		return allowAdmissionResponse()
+	}
+	return toAdmissionResponse(fmt.Errorf("user %s is not allowed to %s pod %s:%s which uses %s",
+		req.UserInfo.Username, req.SubResource, req.Namespace, req.Name, permission), http.StatusForbidden)
+}
+
+// Serve is a handler function of ConnectAdmissionServer
+func (s *ConnectAdmissionServer) Serve(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, s.admit)
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// PodExemptedByAnn records the user or group exemption (such as user=admin) the pod is created by,
+	// it is set by the mutating web hook since the creator of a running pod is unknown.
+	PodExemptedByAnn = "io.enndata.nshp/exempted-by"
+
+	exemptionKindServiceAccount = "serviceaccount"
+	exemptionKindUser           = "user"
+	exemptionKindGroup          = "group"
+)
+
+// Exemptions holds the service accounts, users and groups which are allowed
+// to use hostpath and privilege even if the namespace does not allow them.
+type Exemptions struct {
+	serviceAccounts map[string]struct{}
+	users           map[string]struct{}
+	groups          map[string]struct{}
+}
+
+func toStrMap(strs []string) map[string]struct{} {
+	strMap := make(map[string]struct{}, len(strs))
+	for _, str := range strs {
+		if str = strings.TrimSpace(str); str != "" {
+			strMap[str] = struct{}{}
+		}
+	}
+	return strMap
+}
+
+// NewExemptions constructs new Exemptions, serviceAccounts should be formatted as namespace:name
+func NewExemptions(serviceAccounts, users, groups []string) (*Exemptions, error) {
+	for _, sa := range serviceAccounts {
+		if sa = strings.TrimSpace(sa); sa == "" {
+			continue
+		}
+		if strs := strings.Split(sa, ":"); len(strs) != 2 || strs[0] == "" || strs[1] == "" {
+			return nil, fmt.Errorf("exempt serviceaccount %s should be formatted as namespace:name", sa)
+		}
+	}
+	return &Exemptions{
+		serviceAccounts: toStrMap(serviceAccounts),
+		users:           toStrMap(users),
+		groups:          toStrMap(groups),
+	}, nil
+}
+
+func getPodServiceAccountName(pod *v1.Pod) string {
+	if pod.Spec.ServiceAccountName == "" {
+		return "default"
+	}
+	return pod.Spec.ServiceAccountName
+}
+
+// hasUserExemptions returns true if any user or group is exempted, whether they apply to
+// a running pod can not be verified since its creator is unknown.
+func (e *Exemptions) hasUserExemptions() bool {
+	return e != nil && (len(e.users) > 0 || len(e.groups) > 0)
+}
+
+// matchUser returns the user or group exemption userInfo hits, formatted as kind=name,
+// empty is returned if there is none.
+func (e *Exemptions) matchUser(userInfo authenticationv1.UserInfo) string {
+	kind, name, exempt := e.match(nil, "", userInfo)
+	if exempt == false {
+		return ""
+	}
+	return kind + "=" + name
+}
+
+// recordUserExemption sets PodExemptedByAnn of pod to exemptedBy, the value set by the user is
+// removed if the pod is not exempted. It returns true if the annotation is changed.
+func recordUserExemption(pod *v1.Pod, exemptedBy string) bool {
+	if pod.Annotations[PodExemptedByAnn] == exemptedBy {
+		return false
+	}
+	if exemptedBy == "" {
+		delete(pod.Annotations, PodExemptedByAnn)
+		return true
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[PodExemptedByAnn] = exemptedBy
+	return true
+}
+
+// checkUserExemptionRecord checks that PodExemptedByAnn of pod is set by the mutating web hook,
+// it is empty or the exemption the creator hits when the pod is created, and it is not changed
+// when the pod is updated. The pod templates of the workload controllers can not set it.
+func (s *AdmissionServer) checkUserExemptionRecord(pod *v1.Pod, req *v1beta1.AdmissionRequest) (bool, error) {
+	value := pod.Annotations[PodExemptedByAnn]
+	if value == "" {
+		return true, nil
+	}
+	if req.Resource != podResource {
+		return false, nil
+	}
+	if req.Operation == v1beta1.Create {
+		return value == s.exemptions.matchUser(req.UserInfo), nil
+	}
+	oldPod := v1.Pod{}
+	if err := json.Unmarshal(req.OldObject.Raw, &oldPod); err != nil {
+		return false, err
+	}
+	return value == oldPod.Annotations[PodExemptedByAnn], nil
+}
+
+// match returns the kind and the name of the exemption that pod or the requesting user hits
+func (e *Exemptions) match(pod *v1.Pod, namespace string, userInfo authenticationv1.UserInfo) (kind, name string, exempt bool) {
+	if e == nil {
+		return "", "", false
+	}
+	if pod != nil {
+		sa := fmt.Sprintf("%s:%s", namespace, getPodServiceAccountName(pod))
+		if _, exist := e.serviceAccounts[sa]; exist {
+			return exemptionKindServiceAccount, sa, true
+		}
+	}
+	if _, exist := e.users[userInfo.Username]; exist {
+		return exemptionKindUser, userInfo.Username, true
+	}
+	for _, group := range userInfo.Groups {
+		if _, exist := e.groups[group]; exist {
+			return exemptionKindGroup, group, true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Rhealb/admission-controller/pkg/common"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	// the grant of NamespaceAllowHostPathAnn and NamespaceAllowPrivilegeAnn is not honored after
+	// the time (RFC3339) of the expiretime annotation, the approver annotation records who approved it.
+	NamespaceAllowHostPathExpireAnn    = "io.enndata.namespace/alpha-allowhostpath-expiretime"
+	NamespaceAllowHostPathApproverAnn  = "io.enndata.namespace/alpha-allowhostpath-approver"
+	NamespaceAllowPrivilegeExpireAnn   = "io.enndata.namespace/alpha-allowprivilege-expiretime"
+	NamespaceAllowPrivilegeApproverAnn = "io.enndata.namespace/alpha-allowprivilege-approver"
+
+	eventComponent  = "nshostpathprivilege"
+	maxReportPodNum = 10
+)
+
+// namespaceGrant describes the annotations of a permission grant of namespace
+type namespaceGrant struct {
+	permission  string
+	allowAnn    string
+	expireAnn   string
+	approverAnn string
+	isPodUse    func(s *AdmissionServer, pod *v1.Pod) (bool, error)
+}
+
+var namespaceGrants = []namespaceGrant{
+	{
+		permission:  permissionHostPath,
+		allowAnn:    NamespaceAllowHostPathAnn,
+		expireAnn:   NamespaceAllowHostPathExpireAnn,
+		approverAnn: NamespaceAllowHostPathApproverAnn,
+		isPodUse:    (*AdmissionServer).isPodUsingHostPath,
+	},
+	{
+		permission:  permissionPrivilege,
+		allowAnn:    NamespaceAllowPrivilegeAnn,
+		expireAnn:   NamespaceAllowPrivilegeExpireAnn,
+		approverAnn: NamespaceAllowPrivilegeApproverAnn,
+		isPodUse:    (*AdmissionServer).isPodUsingPrivilege,
+	},
+}
+
+// isPodUsingHostPath returns true if the pod uses hostpath inline or through the hostpath pvs
+// the same as the admission checks
+func (s *AdmissionServer) isPodUsingHostPath(pod *v1.Pod) (bool, error) {
+	hostPathPVs, err := s.getPodHostPathPVs(pod)
+	if err != nil {
+		return false, err
+	}
+	return len(getHostPathVolumeNames(pod, hostPathPVs)) > 0, nil
+}
+
+func (s *AdmissionServer) isPodUsingPrivilege(pod *v1.Pod) (bool, error) {
+	return isPodPrivilge(pod), nil
+}
+
+// getGrantExpireTime returns the expire time of the grant, nil means the grant never expires
+func getGrantExpireTime(ns *v1.Namespace, expireAnn string) (*time.Time, error) {
+	if ns == nil || ns.Annotations == nil || ns.Annotations[expireAnn] == "" {
+		return nil, nil
+	}
+	expireTime, err := time.Parse(time.RFC3339, ns.Annotations[expireAnn])
+	if err != nil {
+		return nil, fmt.Errorf("parse %s of namespace %s err:%v", expireAnn, ns.Name, err)
+	}
+	return &expireTime, nil
+}
+
+// isNamespaceGrantValid returns true if namespace grants the permission of allowAnn and the grant has not expired
+func isNamespaceGrantValid(ns *v1.Namespace, allowAnn, expireAnn string, now time.Time) bool {
+	if ns == nil || ns.Annotations == nil || ns.Annotations[allowAnn] != "true" {
+		return false
+	}
+	expireTime, err := getGrantExpireTime(ns, expireAnn)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return false
+	}
+	return expireTime == nil || now.Before(*expireTime)
+}
+
+// GrantExpireController removes the expired grants from namespaces
+type GrantExpireController struct {
+	client           *kubernetes.Clientset
+	namespacesLister corelisters.NamespaceLister
+	server           *AdmissionServer
+	interval         time.Duration
+	reportPods       bool
+}
+
+// NewGrantExpireController constructs new GrantExpireController, the pods using the permissions
+// are found by server.
+func NewGrantExpireController(client *kubernetes.Clientset, namespacesLister corelisters.NamespaceLister, server *AdmissionServer,
+	interval time.Duration, reportPods bool) *GrantExpireController {
+	return &GrantExpireController{
+		client:           client,
+		namespacesLister: namespacesLister,
+		server:           server,
+		interval:         interval,
+		reportPods:       reportPods,
+	}
+}
+
+// Run checks the grants of all namespaces every interval until stopCh is closed
+func (c *GrantExpireController) Run(stopCh <-chan struct{}) {
+	glog.Infof("GrantExpireController started, interval:%v", c.interval)
+	wait.Until(c.sync, c.interval, stopCh)
+	glog.Infof("GrantExpireController stopped")
+}
+
+func (c *GrantExpireController) sync() {
+	namespaces, err := c.namespacesLister.List(labels.Everything())
+	if err != nil {
+		glog.Errorf("GrantExpireController list namespaces err:%v", err)
+		return
+	}
+	now := time.Now()
+	for _, ns := range namespaces {
+		for _, grant := range namespaceGrants {
+			expireTime, err := getGrantExpireTime(ns, grant.expireAnn)
+			if err != nil {
+				glog.Errorf("GrantExpireController %v", err)
+				continue
+			}
+			if expireTime == nil || now.Before(*expireTime) {
+				continue
+			}
+			if err := c.removeGrant(ns.Name, grant); err != nil {
+				glog.Errorf("GrantExpireController remove %s grant of namespace %s err:%v", grant.permission, ns.Name, err)
+			}
+		}
+	}
+}
+
+func (c *GrantExpireController) removeGrant(nsName string, grant namespaceGrant) error {
+	ns, err := c.client.CoreV1().Namespaces().Get(nsName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if ns.Annotations == nil || ns.Annotations[grant.expireAnn] == "" {
+		return nil
+	}
+	expireTimeStr, approver := ns.Annotations[grant.expireAnn], ns.Annotations[grant.approverAnn]
+	delete(ns.Annotations, grant.allowAnn)
+	delete(ns.Annotations, grant.expireAnn)
+	delete(ns.Annotations, grant.approverAnn)
+	if _, err := c.client.CoreV1().Namespaces().Update(ns); err != nil {
+		if errors.IsConflict(err) {
+			// updated by other replicas or users, it will be checked at next sync
+			return nil
+		}
+		return err
+	}
+	message := fmt.Sprintf("%s grant approved by %q expired at %s and has been removed", grant.permission, approver, expireTimeStr)
+	if c.reportPods {
+		if podNames, err := c.getPodsUsingPermission(nsName, grant); err != nil {
+			glog.Errorf("GrantExpireController get pods using %s of namespace %s err:%v", grant.permission, nsName, err)
+		} else if len(podNames) > 0 {
+			if len(podNames) > maxReportPodNum {
+				podNames = append(podNames[:maxReportPodNum], "...")
+			}
+			message = fmt.Sprintf("%s, pods still running with %s: %s", message, grant.permission, strings.Join(podNames, ","))
+		}
+	}
+	glog.Infof("namespace %s: %s", nsName, message)
+	if err := common.RecordEvent(c.client, common.GetObjectReference("Namespace", ns), eventComponent,
+		v1.EventTypeNormal, "GrantExpired", message); err != nil {
+		glog.Errorf("GrantExpireController record event of namespace %s err:%v", nsName, err)
+	}
+	return nil
+}
+
+func (c *GrantExpireController) getPodsUsingPermission(nsName string, grant namespaceGrant) ([]string, error) {
+	pods, err := c.client.CoreV1().Pods(nsName).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		if use, err := grant.isPodUse(c.server, pod); err != nil {
+			return ret, err
+		} else if use {
+			ret = append(ret, pod.Name)
+		}
+	}
+	return ret, nil
+}
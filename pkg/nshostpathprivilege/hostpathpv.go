@@ -0,0 +1,213 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Rhealb/extender-scheduler/pkg/algorithm"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	defaultStorageClassAnn = "storageclass.kubernetes.io/is-default-class"
+	noProvisioner          = "kubernetes.io/no-provisioner"
+	inTreeHostPath         = "kubernetes.io/host-path"
+)
+
+// getClaim returns the pvc from the cache, it is got from the apiserver if it is not in the
+// cache yet (such as the pvcs just created by the statefulset controller).
+func (s *AdmissionServer) getClaim(namespace, name string) (*v1.PersistentVolumeClaim, error) {
+	pvc, err := s.pvcInfo.GetPersistentVolumeClaimInfo(namespace, name)
+	if err == nil || errors.IsNotFound(err) == false {
+		return pvc, err
+	}
+	return s.client.CoreV1().PersistentVolumeClaims(namespace).Get(name, metav1.GetOptions{})
+}
+
+// getClaimStorageClassName returns the storage class of the pvc, the default storage class
+// is returned if it is not set (the pvc may not be defaulted yet).
+func (s *AdmissionServer) getClaimStorageClassName(pvc *v1.PersistentVolumeClaim) (string, error) {
+	if pvc.Spec.StorageClassName != nil {
+		return *pvc.Spec.StorageClassName, nil
+	}
+	classes, err := s.scLister.List(labels.Everything())
+	if err != nil {
+		return "", err
+	}
+	for _, class := range classes {
+		if class.Annotations[defaultStorageClassAnn] == "true" {
+			return class.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// newProvisionedPV returns a pv like the ones the provisioner of class creates, the volume source
+// is left empty for the in-tree provisioners except host-path because their types are not known.
+func newProvisionedPV(class *storagev1.StorageClass) *v1.PersistentVolume {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: fmt.Sprintf("<provisioned by %s>", class.Name),
+		},
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName: class.Name,
+		},
+	}
+	if class.Provisioner == inTreeHostPath {
+		pv.Spec.HostPath = &v1.HostPathVolumeSource{}
+	} else if strings.HasPrefix(class.Provisioner, "kubernetes.io/") == false {
+		pv.Spec.CSI = &v1.CSIPersistentVolumeSource{Driver: class.Provisioner}
+	}
+	return pv
+}
+
+// predictClaimPV predicts the pv which the unbound pvc will be bound to:
+// 1) the pv it is pre-bound to by volumeName.
+// 2) an available pv matching its storage class and selector, the hostpath ones are preferred
+// since they are checked most strictly.
+// 3) the pv the provisioner of its storage class will create.
+// nil is returned if the pv can not be predicted.
+func (s *AdmissionServer) predictClaimPV(pvc *v1.PersistentVolumeClaim) (*v1.PersistentVolume, error) {
+	if pvc.Spec.VolumeName != "" {
+		pv, err := s.pvInfo.GetPersistentVolumeInfo(pvc.Spec.VolumeName)
+		if err != nil && errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return pv, err
+	}
+	className, err := s.getClaimStorageClassName(pvc)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := labels.Everything()
+	if pvc.Spec.Selector != nil {
+		if selector, err = metav1.LabelSelectorAsSelector(pvc.Spec.Selector); err != nil {
+			return nil, err
+		}
+	}
+	pvs, err := s.pvInfo.List()
+	if err != nil {
+		return nil, err
+	}
+	var matched *v1.PersistentVolume
+	for _, pv := range pvs {
+		if pv.Spec.ClaimRef != nil || pv.Status.Phase != v1.VolumeAvailable || pv.Spec.StorageClassName != className ||
+			selector.Matches(labels.Set(pv.Labels)) == false {
+			continue
+		}
+		if algorithm.IsCommonHostPathPV(pv) {
+			return pv, nil
+		}
+		if matched == nil {
+			matched = pv
+		}
+	}
+	if matched != nil || className == "" {
+		return matched, nil
+	}
+
+	class, err := s.scLister.Get(className)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if class.Provisioner == noProvisioner {
+		return nil, nil
+	}
+	return newProvisionedPV(class), nil
+}
+
+// getPodVolumePV returns the pv which the pvc of volume is bound to, the pv is predicted if the pvc
+// is not bound yet. nil is returned if the volume is not a pvc, or the pvc is not found or its pv
+// can not be predicted, the callers should treat such pvc volumes as not resolved.
+func (s *AdmissionServer) getPodVolumePV(pod *v1.Pod, volume v1.Volume) (*v1.PersistentVolume, error) {
+	pvcSource := volume.VolumeSource.PersistentVolumeClaim
+	if pvcSource == nil {
+		return nil, nil
+	}
+	pvc, err := s.getClaim(pod.Namespace, pvcSource.ClaimName)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			glog.V(4).Infof("pvc %s:%s of pod %s is not found", pod.Namespace, pvcSource.ClaimName, pod.Name)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get pvc %s:%s err:%v", pod.Namespace, pvcSource.ClaimName, err)
+	}
+	if pvc.Status.Phase == v1.ClaimBound {
+		// the pvc may be got from the apiserver, so its pv is got by volumeName instead of the pvc cache
+		pv, err := s.pvInfo.GetPersistentVolumeInfo(pvc.Spec.VolumeName)
+		if err != nil && errors.IsNotFound(err) {
+			pv, err = s.client.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get pv %s of pvc %s:%s err:%v", pvc.Spec.VolumeName, pod.Namespace, pvcSource.ClaimName, err)
+		}
+		return pv, nil
+	}
+	pv, err := s.predictClaimPV(pvc)
+	if err != nil {
+		return nil, fmt.Errorf("predict pv of pvc %s:%s err:%v", pod.Namespace, pvcSource.ClaimName, err)
+	}
+	if pv != nil {
+		glog.V(4).Infof("pvc %s:%s of pod %s is not bound, predicted pv %s", pod.Namespace, pvcSource.ClaimName, pod.Name, pv.Name)
+	}
+	return pv, nil
+}
+
+// getPodHostPathPVs returns the hostpath and csi hostpath pvs used by the pod through pvcs,
+// keyed by the names of the pod volumes. The pvcs whose pvs are not resolved are returned with
+// an empty pv name since they may be bound to hostpath pvs after the pod is admitted.
+func (s *AdmissionServer) getPodHostPathPVs(pod *v1.Pod) (map[string]string, error) {
+	ret := make(map[string]string)
+	if s.checkHostPathPV == false || pod == nil {
+		return ret, nil
+	}
+	for _, volume := range pod.Spec.Volumes {
+		pv, err := s.getPodVolumePV(pod, volume)
+		if err != nil {
+			return ret, fmt.Errorf("get pod %s:%s volume %s pv err:%v", pod.Namespace, pod.Name, volume.Name, err)
+		}
+		if volume.PersistentVolumeClaim != nil && pv == nil {
+			ret[volume.Name] = ""
+		} else if pv != nil && algorithm.IsCommonHostPathPV(pv) {
+			ret[volume.Name] = pv.Name
+		}
+	}
+	return ret, nil
+}
+
+// getHostPathVolumeNames returns the names of the pod volumes which are hostpath inline or
+// use the hostpathPVs got by getPodHostPathPVs
+func getHostPathVolumeNames(pod *v1.Pod, hostPathPVs map[string]string) map[string]bool {
+	ret := make(map[string]bool)
+	for _, volume := range pod.Spec.Volumes {
+		if _, isHostPathPV := hostPathPVs[volume.Name]; volume.HostPath != nil || isHostPathPV {
+			ret[volume.Name] = true
+		}
+	}
+	return ret
+}
@@ -18,9 +18,9 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/Rhealb/admission-controller/pkg/utils/metrics"
@@ -43,6 +43,21 @@ var (
 	serverUrl         = flag.String("serverurl", "", "The server url of this controller.")
 	registConfigAuto  = flag.Bool("auto-regist-config", true, "Need regist hook config automatically")
 	kubeConfig        = flag.String("kubeconfig", "", "kube config file path")
+	exemptSAs         = flag.String("exempt-serviceaccounts", "", "The serviceaccounts(namespace:name) whose pods can use hostpath and privilege in any namespace, separated by ','")
+	exemptUsers       = flag.String("exempt-users", "", "The users who can create pods using hostpath and privilege in any namespace, separated by ','")
+	exemptGroups      = flag.String("exempt-groups", "", "The groups whose users can create pods using hostpath and privilege in any namespace, separated by ','")
+	grantInterval     = flag.Duration("grant-expire-check-interval", 1*time.Minute, "The interval to remove expired hostpath and privilege grants of namespaces, 0 means disabled")
+	reportGrantPods   = flag.Bool("report-grant-expired-pods", false, "Report the pods still running with the permission when its grant expired")
+	scanInterval      = flag.Duration("scan-interval", 0, "The interval to scan the existing pods which use hostpath or privilege their namespace does not allow, 0 means disabled")
+	evictViolatingPod = flag.Bool("evict-violating-pods", false, "Evict the pods found by the scanner")
+	checkHostPathPV   = flag.Bool("check-hostpath-pv", true, "Treat the pods using hostpath or csi hostpath pv through pvc as using hostpath")
+	enableMutate      = flag.Bool("enable-mutate", false, "Regist the mutating web hook which strips privilege and makes hostpath readOnly in mutate mode namespaces")
+	mutateConfigName  = flag.String("mutate-config-name", "nshostpathprivilege-mutate", "The nshostpathprivilege mutating web hook config name.")
+	namespaceWait     = flag.Duration("namespace-wait", 2*time.Second, "The max time to wait for a namespace not in the cache yet, such as a newly created one")
+	namespaceFailPol  = flag.String("namespace-fail-policy", "closed", "How to handle the requests whose namespace can't be got, closed rejects them and open allows them")
+	enableConnect     = flag.Bool("enable-connect-check", false, "Regist the web hook which checks exec, attach and portforward into the privileged or hostpath pods")
+	connectGroups     = flag.String("connect-allowed-groups", "system:masters", "The groups whose users can exec, attach and portforward into the privileged or hostpath pods, separated by ','")
+	connectConfigName = flag.String("connect-config-name", "nshostpathprivilege-connect", "The nshostpathprivilege connect web hook config name.")
 )
 
 func main() {
@@ -54,6 +69,15 @@ func main() {
 	metrics.Initialize(*metricAddress, healthCheck)
 	metrics.Register()
 
+	exemptions, err := NewExemptions(strings.Split(*exemptSAs, ","), strings.Split(*exemptUsers, ","), strings.Split(*exemptGroups, ","))
+	if err != nil {
+		glog.Fatalf("parse exemptions err:%v", err)
+	}
+
+	if *namespaceFailPol != "closed" && *namespaceFailPol != "open" {
+		glog.Fatalf("namespace-fail-policy should be closed or open, not %s", *namespaceFailPol)
+	}
+
 	certs := common.InitCerts(*certsDir)
 	clientset, err := common.GetClientByConfig(*kubeConfig)
 	if err != nil {
@@ -64,18 +88,54 @@ func main() {
 	stopEverything := make(chan struct{})
 
 	nsInformer := sharedInformers.Core().V1().Namespaces()
+	pvInformer := sharedInformers.Core().V1().PersistentVolumes()
+	pvcInformer := sharedInformers.Core().V1().PersistentVolumeClaims()
+	scInformer := sharedInformers.Storage().V1().StorageClasses()
 	nsSynced := nsInformer.Informer().HasSynced
-	as := NewAdmissionServer(clientset, nsInformer.Lister())
+	pvSynced := pvInformer.Informer().HasSynced
+	pvcSynced := pvcInformer.Informer().HasSynced
+	scSynced := scInformer.Informer().HasSynced
+	as := NewAdmissionServer(clientset, nsInformer.Lister(), pvInformer.Lister(), pvcInformer.Lister(), scInformer.Lister(), *checkHostPathPV, exemptions, *namespaceWait, *namespaceFailPol == "open")
+	informersSynced := []cache.InformerSynced{nsSynced, pvSynced, pvcSynced, scSynced}
+	if *scanInterval > 0 || *enableConnect {
+		informersSynced = append(informersSynced, sharedInformers.Core().V1().Pods().Informer().HasSynced)
+	}
+	var scanner *ViolationScanner
+	if *scanInterval > 0 {
+		podInformer := sharedInformers.Core().V1().Pods()
+		scanner = NewViolationScanner(clientset, nsInformer.Informer(), nsInformer.Lister(), podInformer.Lister(), as, *scanInterval, *evictViolatingPod, *enableMutate)
+		http.Handle("/violations", scanner)
+	}
+	var connectServer *ConnectAdmissionServer
+	if *enableConnect {
+		connectServer = NewConnectAdmissionServer(clientset, sharedInformers.Core().V1().Pods().Lister(), as, strings.Split(*connectGroups, ","))
+	}
 	sharedInformers.Start(stopEverything)
-	if !cache.WaitForCacheSync(wait.NeverStop, nsSynced) {
-		fmt.Errorf("timed out waiting for namespace caches to sync")
-		os.Exit(-1)
+	if !cache.WaitForCacheSync(wait.NeverStop, informersSynced...) {
+		glog.Fatalf("timed out waiting for namespace, pv, pvc or pod caches to sync")
+	}
+	if scanner != nil {
+		go scanner.Run(stopEverything)
+	}
+	if *grantInterval > 0 {
+		grantController := NewGrantExpireController(clientset, nsInformer.Lister(), as, *grantInterval, *reportGrantPods)
+		go grantController.Run(stopEverything)
 	}
 	var sm http.ServeMux
 	sm.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		as.Serve(w, r)
 		healthCheck.UpdateLastActivity()
 	})
+	sm.HandleFunc(mutatePath, func(w http.ResponseWriter, r *http.Request) {
+		as.ServeMutate(w, r)
+		healthCheck.UpdateLastActivity()
+	})
+	if connectServer != nil {
+		sm.HandleFunc(connectPath, func(w http.ResponseWriter, r *http.Request) {
+			connectServer.Serve(w, r)
+			healthCheck.UpdateLastActivity()
+		})
+	}
 	server := &http.Server{
 		Addr:      *address,
 		TLSConfig: common.ConfigTLS(clientset, certs.ServerCert, certs.ServerKey),
@@ -86,6 +146,12 @@ func main() {
 			glog.Fatalf("servername and serverurl are all empty")
 		}
 		go common.SelfPodValidatingWebHookRegistration(clientset, *webHookConfigName, *serverName, *serverUrl, certs.CaCert)
+		if *enableMutate {
+			go common.SelfNSHPMutatingWebHookRegistration(clientset, *mutateConfigName, *serverName, *serverUrl, mutatePath, certs.CaCert)
+		}
+		if *enableConnect {
+			go common.SelfNSHPConnectWebHookRegistration(clientset, *connectConfigName, *serverName, *serverUrl, connectPath, certs.CaCert)
+		}
 	}
 
 	server.ListenAndServeTLS("", "")
@@ -0,0 +1,196 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Rhealb/admission-controller/pkg/common"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// NamespaceModeAnn selects how the pods using not allowed hostpath or privilege are handled,
+	// "deny" (default) rejects them and "mutate" strips the privileged settings and makes hostpath readOnly.
+	NamespaceModeAnn = "io.enndata.namespace/alpha-hostpathprivilegemode"
+	// PodMutatedAnn lists the fields of the pod changed by the mutate mode
+	PodMutatedAnn = "io.enndata.nshp/mutated-fields"
+
+	namespaceModeDeny   = "deny"
+	namespaceModeMutate = "mutate"
+
+	mutatePath = "/mutate"
+)
+
+func getNamespaceMode(ns *v1.Namespace) string {
+	if ns != nil && ns.Annotations != nil && ns.Annotations[NamespaceModeAnn] == namespaceModeMutate {
+		return namespaceModeMutate
+	}
+	return namespaceModeDeny
+}
+
+// getPodAllContainers returns all the containers of pod and their field paths relative to the pod,
+// such as spec.containers[0]
+func getPodAllContainers(pod *v1.Pod) ([]*v1.Container, []string) {
+	containers := make([]*v1.Container, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	fields := make([]string, 0, cap(containers))
+	for i := range pod.Spec.InitContainers {
+		containers = append(containers, &pod.Spec.InitContainers[i])
+		fields = append(fields, fmt.Sprintf("spec.initContainers[%d]", i))
+	}
+	for i := range pod.Spec.Containers {
+		containers = append(containers, &pod.Spec.Containers[i])
+		fields = append(fields, fmt.Sprintf("spec.containers[%d]", i))
+	}
+	return containers, fields
+}
+
+// isPodHostPathReadOnly returns true if all the mounts of the hostpath volumes are readOnly
+func isPodHostPathReadOnly(pod *v1.Pod, hostPathVolumes map[string]bool) bool {
+	containers, _ := getPodAllContainers(pod)
+	for _, c := range containers {
+		for _, mount := range c.VolumeMounts {
+			if hostPathVolumes[mount.Name] && mount.ReadOnly == false {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// stripPodPrivilege removes privileged and the added capabilities of all containers
+func stripPodPrivilege(pod *v1.Pod) []string {
+	changed := []string{}
+	containers, fields := getPodAllContainers(pod)
+	for i, c := range containers {
+		if c.SecurityContext == nil {
+			continue
+		}
+		if c.SecurityContext.Privileged != nil && *c.SecurityContext.Privileged == true {
+			c.SecurityContext.Privileged = nil
+			changed = append(changed, fields[i]+".securityContext.privileged")
+		}
+		if c.SecurityContext.Capabilities != nil && len(c.SecurityContext.Capabilities.Add) > 0 {
+			c.SecurityContext.Capabilities.Add = nil
+			changed = append(changed, fields[i]+".securityContext.capabilities.add")
+		}
+	}
+	return changed
+}
+
+// makePodHostPathReadOnly makes all the mounts of the hostpath volumes readOnly
+func makePodHostPathReadOnly(pod *v1.Pod, hostPathVolumes map[string]bool) []string {
+	changed := []string{}
+	containers, fields := getPodAllContainers(pod)
+	for i, c := range containers {
+		for j := range c.VolumeMounts {
+			mount := &c.VolumeMounts[j]
+			if hostPathVolumes[mount.Name] && mount.ReadOnly == false {
+				mount.ReadOnly = true
+				changed = append(changed, fmt.Sprintf("%s.volumeMounts[%d].readOnly", fields[i], j))
+			}
+		}
+	}
+	return changed
+}
+
+// mutatePod strips the privilege and makes the hostpath readOnly if ns does not allow them,
+// the changed fields are returned.
+func (s *AdmissionServer) mutatePod(pod *v1.Pod, ns *v1.Namespace) ([]string, error) {
+	changed := []string{}
+	if isNamespaceAllowPrivilege(ns) == false {
+		changed = append(changed, stripPodPrivilege(pod)...)
+	}
+	if isNamespaceAllowHostPath(ns) == false {
+		checkPod := pod.DeepCopy()
+		checkPod.Namespace = ns.Name
+		hostPathPVs, err := s.getPodHostPathPVs(checkPod)
+		if err != nil {
+			return changed, err
+		}
+		changed = append(changed, makePodHostPathReadOnly(pod, getHostPathVolumeNames(pod, hostPathPVs))...)
+	}
+	return changed, nil
+}
+
+// isExemptedNoRecord is the same as isExempted but the exemption is not recorded,
+// it is recorded when the mutated pod is validated.
+func (s *AdmissionServer) isExemptedNoRecord(pod *v1.Pod, req *v1beta1.AdmissionRequest) bool {
+	_, _, exempt := s.exemptions.match(pod, req.Namespace, getPodCreator(req))
+	return exempt
+}
+
+func (s *AdmissionServer) mutate(ctx context.Context, ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+	if ar.Request == nil || ar.Request.Resource != podResource {
+		glog.Errorf("expect resource to be %s", podResource)
+		return nil
+	}
+	if ar.Request.Operation != v1beta1.Create {
+		glog.Errorf("unexpect operation %s", ar.Request.Operation)
+		return nil
+	}
+
+	pod := v1.Pod{}
+	if err := json.Unmarshal(ar.Request.Object.Raw, &pod); err != nil {
+		glog.Error(err)
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	}
+	checkPod := pod.DeepCopy()
+	checkPod.Namespace = ar.Request.Namespace
+	recorded := recordUserExemption(&pod, s.exemptions.matchUser(getPodCreator(ar.Request)))
+	ns, err := s.namespaceGetter.Get(ctx, ar.Request.Namespace)
+	if err != nil {
+		// the pod is not mutated and the validating web hook decides whether it is allowed
+		glog.Errorf("get namespace %s err:%v", ar.Request.Namespace, err)
+		ns = nil
+	}
+	changed := []string{}
+	if ns != nil && getNamespaceMode(ns) == namespaceModeMutate && s.isExemptedNoRecord(checkPod, ar.Request) == false {
+		if changed, err = s.mutatePod(&pod, ns); err != nil {
+			return toAdmissionResponse(err, http.StatusInternalServerError)
+		}
+	}
+	if len(changed) == 0 && recorded == false {
+		return allowAdmissionResponse()
+	}
+	if len(changed) > 0 {
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		pod.Annotations[PodMutatedAnn] = strings.Join(changed, ",")
+	}
+
+	if newPodJson, err := json.Marshal(&pod); err != nil {
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	} else if patch, errPath := common.CreatePatch(ar.Request.Object.Raw, newPodJson); errPath != nil {
+		return toAdmissionResponse(errPath, http.StatusInternalServerError)
+	} else {
+		var patchType = v1beta1.PatchTypeJSONPatch
+		glog.Infof("mutate pod %s:%s: %v", ar.Request.Namespace, ar.Request.Name, changed)
+		return &v1beta1.AdmissionResponse{
+			Allowed:   true,
+			PatchType: &patchType,
+			Patch:     patch,
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	namespacePollInterval = 50 * time.Millisecond
+	// the namespaces not found are remembered for a while so that the requests
+	// of a missing namespace do not wait one after another.
+	namespaceNegativeCacheTTL = 10 * time.Second
+	// the time reserved for writing the response before the request deadline
+	requestDeadlineMargin = 100 * time.Millisecond
+)
+
+// NamespaceGetter gets the namespaces from the informer cache only, a namespace which is not
+// in the cache is waited for a while because the informer may not catch up with a new namespace.
+type NamespaceGetter struct {
+	namespacesLister corelisters.NamespaceLister
+	wait             time.Duration
+
+	mu       sync.Mutex
+	notFound map[string]time.Time
+}
+
+// NewNamespaceGetter constructs new NamespaceGetter
+func NewNamespaceGetter(namespacesLister corelisters.NamespaceLister, wait time.Duration) *NamespaceGetter {
+	return &NamespaceGetter{
+		namespacesLister: namespacesLister,
+		wait:             wait,
+		notFound:         make(map[string]time.Time),
+	}
+}
+
+func (g *NamespaceGetter) isNotFoundCached(name string, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	expire, exist := g.notFound[name]
+	if exist && now.After(expire) {
+		delete(g.notFound, name)
+		return false
+	}
+	return exist
+}
+
+func (g *NamespaceGetter) cacheNotFound(name string, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for ns, expire := range g.notFound {
+		if now.After(expire) {
+			delete(g.notFound, ns)
+		}
+	}
+	g.notFound[name] = now.Add(namespaceNegativeCacheTTL)
+}
+
+// Get returns the namespace, a NotFound error is returned if it is still not in the cache
+// after waiting, and ctx.Err() is returned if ctx is done before that.
+func (g *NamespaceGetter) Get(ctx context.Context, name string) (*v1.Namespace, error) {
+	ns, err := g.namespacesLister.Get(name)
+	if err == nil || errors.IsNotFound(err) == false {
+		return ns, err
+	}
+	if g.isNotFoundCached(name, time.Now()) {
+		return nil, err
+	}
+
+	timer := time.NewTimer(g.wait)
+	defer timer.Stop()
+	ticker := time.NewTicker(namespacePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			g.cacheNotFound(name, time.Now())
+			return nil, err
+		case <-ticker.C:
+			ns, err = g.namespacesLister.Get(name)
+			if err == nil || errors.IsNotFound(err) == false {
+				return ns, err
+			}
+		}
+	}
+}
+
+// getRequestContext returns the context of the admission request which is done when the client
+// goes away or the timeout (sent by the newer kube-apiservers) of the request is reached.
+func getRequestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if timeout, err := time.ParseDuration(r.URL.Query().Get("timeout")); err == nil && timeout > requestDeadlineMargin {
+		return context.WithTimeout(r.Context(), timeout-requestDeadlineMargin)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// namespaceLookupFailed returns the response when the namespace of the request can't be got,
+// the request is rejected with a clear reason unless it fails open.
+func (s *AdmissionServer) namespaceLookupFailed(req *v1beta1.AdmissionRequest, err error) *v1beta1.AdmissionResponse {
+	var code int32 = http.StatusServiceUnavailable
+	message := fmt.Sprintf("namespace %s is not available: %v", req.Namespace, err)
+	if errors.IsNotFound(err) {
+		code = http.StatusForbidden
+		message = fmt.Sprintf("namespace %s is not found", req.Namespace)
+	} else if err == context.DeadlineExceeded || err == context.Canceled {
+		message = fmt.Sprintf("timed out waiting for namespace %s", req.Namespace)
+	}
+	if s.namespaceFailOpen {
+		glog.Warningf("%s %s:%s is allowed by fail-open: %s", req.Resource.Resource, req.Namespace, req.Name, message)
+		response := allowAdmissionResponse()
+		response.AuditAnnotations = map[string]string{"namespace-lookup": "fail-open: " + message}
+		return response
+	}
+	glog.Errorf("%s %s:%s is rejected: %s", req.Resource.Resource, req.Namespace, req.Name, message)
+	return toAdmissionResponse(fmt.Errorf("%s", message), code)
+}
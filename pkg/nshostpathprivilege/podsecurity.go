@@ -0,0 +1,605 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// The Pod Security Standards (https://kubernetes.io/docs/concepts/security/pod-security-standards/)
+// are evaluated here for the clusters without the built-in PodSecurity admission, the check names
+// and the forbidden reasons are the same as the upstream ones.
+const (
+	// NamespacePodSecurityLabel is the upstream label selecting the level of namespace
+	NamespacePodSecurityLabel = "pod-security.kubernetes.io/enforce"
+	// NamespacePodSecurityAnn selects the level of namespace if the label is not set
+	NamespacePodSecurityAnn = "io.enndata.namespace/alpha-podsecurity"
+
+	podSecurityPrivileged = "privileged"
+	podSecurityBaseline   = "baseline"
+	podSecurityRestricted = "restricted"
+
+	permissionPodSecurity = "podsecurity"
+
+	appArmorAnnotationKeyPrefix = "container.apparmor.security.beta.kubernetes.io/"
+)
+
+// PodSecurityViolation is a failed check of the Pod Security Standards
+type PodSecurityViolation struct {
+	// Check is the upstream check name, such as hostPathVolumes
+	Check string
+	// Field is the field path of the pod the check looks at
+	Field string
+	// Reason is the upstream forbidden reason, such as "hostPath volumes"
+	Reason string
+	// Detail describes the fields violating the check
+	Detail string
+}
+
+type podSecurityCheck struct {
+	name  string
+	level string
+	field string
+	// permission is the namespace grant which makes the check an explicit exception
+	permission string
+	check      func(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation
+}
+
+var podSecurityChecks = []podSecurityCheck{
+	{name: "hostNamespaces", field: "spec", level: podSecurityBaseline, check: checkHostNamespaces},
+	{name: "privileged", field: "spec.containers[*].securityContext.privileged", level: podSecurityBaseline, permission: permissionPrivilege, check: checkPrivileged},
+	{name: "capabilities_baseline", field: "spec.containers[*].securityContext.capabilities.add", level: podSecurityBaseline, permission: permissionPrivilege, check: checkCapabilitiesBaseline},
+	{name: "hostPathVolumes", field: "spec.volumes[*].hostPath", level: podSecurityBaseline, permission: permissionHostPath, check: checkHostPathVolumes},
+	{name: "hostPorts", field: "spec.containers[*].ports[*].hostPort", level: podSecurityBaseline, check: checkHostPorts},
+	{name: "appArmorProfile", field: "metadata.annotations", level: podSecurityBaseline, check: checkAppArmorProfile},
+	{name: "seLinuxOptions", field: "spec.securityContext.seLinuxOptions", level: podSecurityBaseline, check: checkSELinuxOptions},
+	{name: "procMount", field: "spec.containers[*].securityContext.procMount", level: podSecurityBaseline, check: checkProcMount},
+	{name: "seccompProfile_baseline", field: "metadata.annotations", level: podSecurityBaseline, check: checkSeccompProfileBaseline},
+	{name: "sysctls", field: "spec.securityContext.sysctls", level: podSecurityBaseline, check: checkSysctls},
+	{name: "restrictedVolumes", field: "spec.volumes[*]", level: podSecurityRestricted, check: checkRestrictedVolumes},
+	{name: "allowPrivilegeEscalation", field: "spec.containers[*].securityContext.allowPrivilegeEscalation", level: podSecurityRestricted, permission: permissionPrivilege, check: checkAllowPrivilegeEscalation},
+	{name: "runAsNonRoot", field: "spec.securityContext.runAsNonRoot", level: podSecurityRestricted, check: checkRunAsNonRoot},
+	{name: "runAsUser", field: "spec.securityContext.runAsUser", level: podSecurityRestricted, check: checkRunAsUser},
+	{name: "seccompProfile_restricted", field: "metadata.annotations", level: podSecurityRestricted, check: checkSeccompProfileRestricted},
+	{name: "capabilities_restricted", field: "spec.containers[*].securityContext.capabilities", level: podSecurityRestricted, permission: permissionPrivilege, check: checkCapabilitiesRestricted},
+}
+
+func getNamespacePodSecurityLevel(ns *v1.Namespace) string {
+	if ns == nil {
+		return podSecurityPrivileged
+	}
+	level := ns.Labels[NamespacePodSecurityLabel]
+	if level == "" {
+		level = ns.Annotations[NamespacePodSecurityAnn]
+	}
+	switch level {
+	case podSecurityBaseline, podSecurityRestricted:
+		return level
+	}
+	return podSecurityPrivileged
+}
+
+// evaluatePodSecurity returns the violations of pod against level, the checks of the
+// permissions in allowed are skipped as the explicit exceptions of namespace.
+func evaluatePodSecurity(pod *v1.Pod, level string, allowed map[string]bool) []PodSecurityViolation {
+	ret := []PodSecurityViolation{}
+	if level == podSecurityPrivileged {
+		return ret
+	}
+	for _, c := range podSecurityChecks {
+		if c.level == podSecurityRestricted && level != podSecurityRestricted {
+			continue
+		}
+		if c.permission != "" && allowed[c.permission] {
+			continue
+		}
+		if violation := c.check(pod, allowed[permissionHostPath]); violation != nil {
+			violation.Check = c.name
+			violation.Field = c.field
+			ret = append(ret, *violation)
+		}
+	}
+	return ret
+}
+
+func (v PodSecurityViolation) String() string {
+	if v.Detail != "" {
+		return fmt.Sprintf("%s (%s)", v.Reason, v.Detail)
+	}
+	return v.Reason
+}
+
+// formatPodSecurityViolations formats the violations the same as the upstream PodSecurity admission
+func formatPodSecurityViolations(level string, violations []PodSecurityViolation) string {
+	strs := make([]string, 0, len(violations))
+	for _, v := range violations {
+		strs = append(strs, v.String())
+	}
+	return fmt.Sprintf("violates PodSecurity %q: %s", level+":latest", strings.Join(strs, ", "))
+}
+
+func getPodSecurityCheckNames(violations []PodSecurityViolation) string {
+	names := make([]string, 0, len(violations))
+	for _, v := range violations {
+		names = append(names, v.Check)
+	}
+	return strings.Join(names, ",")
+}
+
+// getVolumeSourceType returns the json name of the source of volume, such as hostPath
+func getVolumeSourceType(source interface{}) string {
+	value := reflect.ValueOf(source)
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if field.Kind() == reflect.Ptr && field.IsNil() == false {
+			return strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		}
+	}
+	return ""
+}
+
+func quoteJoin(strs []string) string {
+	quoted := make([]string, 0, len(strs))
+	for _, str := range strs {
+		quoted = append(quoted, fmt.Sprintf("%q", str))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func pluralize(singular, plural string, count int) string {
+	if count == 1 {
+		return singular
+	}
+	return plural
+}
+
+func withBadContainers(badContainers []string, detail string) string {
+	return fmt.Sprintf("%s %s %s", pluralize("container", "containers", len(badContainers)), quoteJoin(badContainers), detail)
+}
+
+func checkHostNamespaces(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	details := []string{}
+	if pod.Spec.HostNetwork {
+		details = append(details, "hostNetwork=true")
+	}
+	if pod.Spec.HostPID {
+		details = append(details, "hostPID=true")
+	}
+	if pod.Spec.HostIPC {
+		details = append(details, "hostIPC=true")
+	}
+	if len(details) == 0 {
+		return nil
+	}
+	return &PodSecurityViolation{Reason: "host namespaces", Detail: strings.Join(details, ", ")}
+}
+
+func checkPrivileged(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	badContainers := []string{}
+	containers, _ := getPodAllContainers(pod)
+	for _, c := range containers {
+		if c.SecurityContext != nil && c.SecurityContext.Privileged != nil && *c.SecurityContext.Privileged {
+			badContainers = append(badContainers, c.Name)
+		}
+	}
+	if len(badContainers) == 0 {
+		return nil
+	}
+	return &PodSecurityViolation{
+		Reason: "privileged",
+		Detail: withBadContainers(badContainers, "must not set securityContext.privileged=true"),
+	}
+}
+
+var baselineCapabilities = map[v1.Capability]bool{
+	"AUDIT_WRITE":      true,
+	"CHOWN":            true,
+	"DAC_OVERRIDE":     true,
+	"FOWNER":           true,
+	"FSETID":           true,
+	"KILL":             true,
+	"MKNOD":            true,
+	"NET_BIND_SERVICE": true,
+	"SETFCAP":          true,
+	"SETGID":           true,
+	"SETPCAP":          true,
+	"SETUID":           true,
+	"SYS_CHROOT":       true,
+}
+
+func getForbiddenCapabilities(pod *v1.Pod, allowedCapabilities map[v1.Capability]bool) ([]string, []string) {
+	badContainers := []string{}
+	forbidden := map[string]bool{}
+	containers, _ := getPodAllContainers(pod)
+	for _, c := range containers {
+		if c.SecurityContext == nil || c.SecurityContext.Capabilities == nil {
+			continue
+		}
+		bad := false
+		for _, capability := range c.SecurityContext.Capabilities.Add {
+			if allowedCapabilities[capability] == false {
+				bad = true
+				forbidden[string(capability)] = true
+			}
+		}
+		if bad {
+			badContainers = append(badContainers, c.Name)
+		}
+	}
+	forbiddenList := make([]string, 0, len(forbidden))
+	for capability := range forbidden {
+		forbiddenList = append(forbiddenList, capability)
+	}
+	sort.Strings(forbiddenList)
+	return badContainers, forbiddenList
+}
+
+func checkCapabilitiesBaseline(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	badContainers, forbidden := getForbiddenCapabilities(pod, baselineCapabilities)
+	if len(badContainers) == 0 {
+		return nil
+	}
+	return &PodSecurityViolation{
+		Reason: "non-default capabilities",
+		Detail: withBadContainers(badContainers, fmt.Sprintf("must not include %s in securityContext.capabilities.add", quoteJoin(forbidden))),
+	}
+}
+
+func checkHostPathVolumes(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	badVolumes := []string{}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.HostPath != nil {
+			badVolumes = append(badVolumes, volume.Name)
+		}
+	}
+	if len(badVolumes) == 0 {
+		return nil
+	}
+	return &PodSecurityViolation{
+		Reason: "hostPath volumes",
+		Detail: fmt.Sprintf("%s %s", pluralize("volume", "volumes", len(badVolumes)), quoteJoin(badVolumes)),
+	}
+}
+
+func checkHostPorts(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	badContainers := []string{}
+	ports := []string{}
+	containers, _ := getPodAllContainers(pod)
+	for _, c := range containers {
+		bad := false
+		for _, port := range c.Ports {
+			if port.HostPort != 0 {
+				bad = true
+				ports = append(ports, fmt.Sprintf("%d", port.HostPort))
+			}
+		}
+		if bad {
+			badContainers = append(badContainers, c.Name)
+		}
+	}
+	if len(badContainers) == 0 {
+		return nil
+	}
+	return &PodSecurityViolation{
+		Reason: "hostPort",
+		Detail: withBadContainers(badContainers, fmt.Sprintf("%s %s", pluralize("uses hostPort", "use hostPorts", len(ports)), strings.Join(ports, ", "))),
+	}
+}
+
+func checkAppArmorProfile(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	forbidden := []string{}
+	for key, value := range pod.Annotations {
+		if strings.HasPrefix(key, appArmorAnnotationKeyPrefix) == false {
+			continue
+		}
+		if value != "" && value != "runtime/default" && strings.HasPrefix(value, "localhost/") == false {
+			forbidden = append(forbidden, fmt.Sprintf("%s=%q", key, value))
+		}
+	}
+	if len(forbidden) == 0 {
+		return nil
+	}
+	sort.Strings(forbidden)
+	return &PodSecurityViolation{
+		Reason: pluralize("forbidden AppArmor profile", "forbidden AppArmor profiles", len(forbidden)),
+		Detail: strings.Join(forbidden, ", "),
+	}
+}
+
+func isSELinuxOptionsAllowed(opts *v1.SELinuxOptions) bool {
+	if opts == nil {
+		return true
+	}
+	switch opts.Type {
+	case "", "container_t", "container_init_t", "container_kvm_t":
+	default:
+		return false
+	}
+	return opts.User == "" && opts.Role == ""
+}
+
+func checkSELinuxOptions(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	bad := []string{}
+	if pod.Spec.SecurityContext != nil && isSELinuxOptionsAllowed(pod.Spec.SecurityContext.SELinuxOptions) == false {
+		bad = append(bad, "pod")
+	}
+	containers, _ := getPodAllContainers(pod)
+	for _, c := range containers {
+		if c.SecurityContext != nil && isSELinuxOptionsAllowed(c.SecurityContext.SELinuxOptions) == false {
+			bad = append(bad, fmt.Sprintf("container %q", c.Name))
+		}
+	}
+	if len(bad) == 0 {
+		return nil
+	}
+	return &PodSecurityViolation{
+		Reason: "seLinuxOptions",
+		Detail: fmt.Sprintf("%s set forbidden securityContext.seLinuxOptions", strings.Join(bad, " and ")),
+	}
+}
+
+func checkProcMount(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	badContainers := []string{}
+	containers, _ := getPodAllContainers(pod)
+	for _, c := range containers {
+		if c.SecurityContext != nil && c.SecurityContext.ProcMount != nil && *c.SecurityContext.ProcMount != v1.DefaultProcMount {
+			badContainers = append(badContainers, c.Name)
+		}
+	}
+	if len(badContainers) == 0 {
+		return nil
+	}
+	return &PodSecurityViolation{
+		Reason: "procMount",
+		Detail: withBadContainers(badContainers, "must not set securityContext.procMount to \"Unmasked\""),
+	}
+}
+
+func getSeccompProfile(pod *v1.Pod, containerName string) string {
+	if containerName == "" {
+		return pod.Annotations[v1.SeccompPodAnnotationKey]
+	}
+	return pod.Annotations[v1.SeccompContainerAnnotationKeyPrefix+containerName]
+}
+
+func checkSeccompProfileBaseline(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	bad := []string{}
+	if getSeccompProfile(pod, "") == "unconfined" {
+		bad = append(bad, "pod")
+	}
+	containers, _ := getPodAllContainers(pod)
+	for _, c := range containers {
+		if getSeccompProfile(pod, c.Name) == "unconfined" {
+			bad = append(bad, fmt.Sprintf("container %q", c.Name))
+		}
+	}
+	if len(bad) == 0 {
+		return nil
+	}
+	return &PodSecurityViolation{
+		Reason: "seccompProfile",
+		Detail: fmt.Sprintf("%s must not set securityContext.seccompProfile.type to \"Unconfined\"", strings.Join(bad, " and ")),
+	}
+}
+
+var safeSysctls = map[string]bool{
+	"kernel.shm_rmid_forced":              true,
+	"net.ipv4.ip_local_port_range":        true,
+	"net.ipv4.ip_unprivileged_port_start": true,
+	"net.ipv4.tcp_syncookies":             true,
+	"net.ipv4.ping_group_range":           true,
+}
+
+func checkSysctls(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	if pod.Spec.SecurityContext == nil {
+		return nil
+	}
+	forbidden := []string{}
+	for _, sysctl := range pod.Spec.SecurityContext.Sysctls {
+		if safeSysctls[sysctl.Name] == false {
+			forbidden = append(forbidden, sysctl.Name)
+		}
+	}
+	if len(forbidden) == 0 {
+		return nil
+	}
+	return &PodSecurityViolation{
+		Reason: "forbidden sysctls",
+		Detail: strings.Join(forbidden, ", "),
+	}
+}
+
+var restrictedVolumeTypes = map[string]bool{
+	"configMap":             true,
+	"downwardAPI":           true,
+	"emptyDir":              true,
+	"persistentVolumeClaim": true,
+	"projected":             true,
+	"secret":                true,
+}
+
+func checkRestrictedVolumes(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	badVolumes := []string{}
+	badTypes := map[string]bool{}
+	for _, volume := range pod.Spec.Volumes {
+		volumeType := getVolumeSourceType(volume.VolumeSource)
+		if restrictedVolumeTypes[volumeType] || (hostPathAllowed && volumeType == "hostPath") {
+			continue
+		}
+		badVolumes = append(badVolumes, volume.Name)
+		badTypes[volumeType] = true
+	}
+	if len(badVolumes) == 0 {
+		return nil
+	}
+	types := make([]string, 0, len(badTypes))
+	for t := range badTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return &PodSecurityViolation{
+		Reason: "restricted volume types",
+		Detail: fmt.Sprintf("%s %s %s %s", pluralize("volume", "volumes", len(badVolumes)), quoteJoin(badVolumes),
+			pluralize("uses restricted volume type", "use restricted volume types", len(types)), quoteJoin(types)),
+	}
+}
+
+func checkAllowPrivilegeEscalation(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	badContainers := []string{}
+	containers, _ := getPodAllContainers(pod)
+	for _, c := range containers {
+		if c.SecurityContext == nil || c.SecurityContext.AllowPrivilegeEscalation == nil || *c.SecurityContext.AllowPrivilegeEscalation {
+			badContainers = append(badContainers, c.Name)
+		}
+	}
+	if len(badContainers) == 0 {
+		return nil
+	}
+	return &PodSecurityViolation{
+		Reason: "allowPrivilegeEscalation != false",
+		Detail: withBadContainers(badContainers, "must set securityContext.allowPrivilegeEscalation=false"),
+	}
+}
+
+func checkRunAsNonRoot(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	podRunAsNonRoot := false
+	badSetters := []string{}
+	if pod.Spec.SecurityContext != nil && pod.Spec.SecurityContext.RunAsNonRoot != nil {
+		if *pod.Spec.SecurityContext.RunAsNonRoot {
+			podRunAsNonRoot = true
+		} else {
+			badSetters = append(badSetters, "pod")
+		}
+	}
+	implicitContainers := []string{}
+	containers, _ := getPodAllContainers(pod)
+	for _, c := range containers {
+		if c.SecurityContext != nil && c.SecurityContext.RunAsNonRoot != nil {
+			if *c.SecurityContext.RunAsNonRoot == false {
+				badSetters = append(badSetters, fmt.Sprintf("container %q", c.Name))
+			}
+			continue
+		}
+		if podRunAsNonRoot == false {
+			implicitContainers = append(implicitContainers, c.Name)
+		}
+	}
+	if len(badSetters) > 0 {
+		return &PodSecurityViolation{
+			Reason: "runAsNonRoot != true",
+			Detail: fmt.Sprintf("%s must not set securityContext.runAsNonRoot=false", strings.Join(badSetters, " and ")),
+		}
+	}
+	if len(implicitContainers) > 0 {
+		return &PodSecurityViolation{
+			Reason: "runAsNonRoot != true",
+			Detail: fmt.Sprintf("pod or %s %s must set securityContext.runAsNonRoot=true",
+				pluralize("container", "containers", len(implicitContainers)), quoteJoin(implicitContainers)),
+		}
+	}
+	return nil
+}
+
+func checkRunAsUser(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	bad := []string{}
+	if pod.Spec.SecurityContext != nil && pod.Spec.SecurityContext.RunAsUser != nil && *pod.Spec.SecurityContext.RunAsUser == 0 {
+		bad = append(bad, "pod")
+	}
+	containers, _ := getPodAllContainers(pod)
+	for _, c := range containers {
+		if c.SecurityContext != nil && c.SecurityContext.RunAsUser != nil && *c.SecurityContext.RunAsUser == 0 {
+			bad = append(bad, fmt.Sprintf("container %q", c.Name))
+		}
+	}
+	if len(bad) == 0 {
+		return nil
+	}
+	return &PodSecurityViolation{
+		Reason: "runAsUser=0",
+		Detail: fmt.Sprintf("%s must not set runAsUser=0", strings.Join(bad, " and ")),
+	}
+}
+
+func isSeccompProfileRestricted(profile string) bool {
+	return profile == "runtime/default" || profile == "docker/default" || strings.HasPrefix(profile, "localhost/")
+}
+
+func checkSeccompProfileRestricted(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	podProfile := getSeccompProfile(pod, "")
+	if podProfile != "" && isSeccompProfileRestricted(podProfile) == false {
+		return &PodSecurityViolation{
+			Reason: "seccompProfile",
+			Detail: "pod must not set securityContext.seccompProfile.type to \"Unconfined\"",
+		}
+	}
+	badContainers := []string{}
+	containers, _ := getPodAllContainers(pod)
+	for _, c := range containers {
+		profile := getSeccompProfile(pod, c.Name)
+		if profile == "" && podProfile != "" {
+			continue
+		}
+		if isSeccompProfileRestricted(profile) == false {
+			badContainers = append(badContainers, c.Name)
+		}
+	}
+	if len(badContainers) == 0 {
+		return nil
+	}
+	return &PodSecurityViolation{
+		Reason: "seccompProfile",
+		Detail: fmt.Sprintf("pod or %s %s must set securityContext.seccompProfile.type to \"RuntimeDefault\" or \"Localhost\"",
+			pluralize("container", "containers", len(badContainers)), quoteJoin(badContainers)),
+	}
+}
+
+func checkCapabilitiesRestricted(pod *v1.Pod, hostPathAllowed bool) *PodSecurityViolation {
+	missingDrop := []string{}
+	containers, _ := getPodAllContainers(pod)
+	for _, c := range containers {
+		dropAll := false
+		if c.SecurityContext != nil && c.SecurityContext.Capabilities != nil {
+			for _, capability := range c.SecurityContext.Capabilities.Drop {
+				if capability == "ALL" {
+					dropAll = true
+				}
+			}
+		}
+		if dropAll == false {
+			missingDrop = append(missingDrop, c.Name)
+		}
+	}
+	badAdd, forbidden := getForbiddenCapabilities(pod, map[v1.Capability]bool{"NET_BIND_SERVICE": true})
+	if len(missingDrop) == 0 && len(badAdd) == 0 {
+		return nil
+	}
+	details := []string{}
+	if len(missingDrop) > 0 {
+		details = append(details, withBadContainers(missingDrop, "must set securityContext.capabilities.drop=[\"ALL\"]"))
+	}
+	if len(badAdd) > 0 {
+		details = append(details, withBadContainers(badAdd, fmt.Sprintf("must not include %s in securityContext.capabilities.add", quoteJoin(forbidden))))
+	}
+	return &PodSecurityViolation{
+		Reason: "unrestricted capabilities",
+		Detail: strings.Join(details, "; "),
+	}
+}
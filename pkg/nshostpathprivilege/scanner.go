@@ -0,0 +1,250 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Rhealb/admission-controller/pkg/common"
+	"github.com/Rhealb/admission-controller/pkg/utils/metrics"
+
+	"github.com/golang/glog"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Violation is a running pod which uses a permission its namespace does not allow any more
+type Violation struct {
+	Namespace  string `json:"namespace"`
+	Pod        string `json:"pod"`
+	Permission string `json:"permission"`
+	// Unverified is set if the pod is admitted by a user or group exemption (recorded by
+	// PodExemptedByAnn), such pods are not evicted.
+	Unverified bool `json:"unverified,omitempty"`
+}
+
+// ViolationReport is the result of the last scan
+type ViolationReport struct {
+	ScanTime   time.Time   `json:"scanTime"`
+	Violations []Violation `json:"violations"`
+}
+
+type podViolation struct {
+	pod        *v1.Pod
+	permission string
+	unverified bool
+}
+
+// ViolationScanner scans the existing pods periodically and when the grants of
+// namespaces are changed, because the annotations only take effect on new pods.
+type ViolationScanner struct {
+	client           *kubernetes.Clientset
+	namespacesLister corelisters.NamespaceLister
+	podsLister       corelisters.PodLister
+	server           *AdmissionServer
+	interval         time.Duration
+	evict            bool
+	// exemptionsRecorded is true if the mutating web hook records the user and group exemptions,
+	// otherwise any violation may be exempted by them if they are set
+	exemptionsRecorded bool
+	trigger            chan struct{}
+
+	mu       sync.Mutex
+	report   ViolationReport
+	reported map[string]bool
+}
+
+// NewViolationScanner constructs new ViolationScanner
+func NewViolationScanner(client *kubernetes.Clientset, nsInformer cache.SharedIndexInformer, namespacesLister corelisters.NamespaceLister,
+	podsLister corelisters.PodLister, server *AdmissionServer, interval time.Duration, evict, exemptionsRecorded bool) *ViolationScanner {
+	vs := &ViolationScanner{
+		client:             client,
+		namespacesLister:   namespacesLister,
+		podsLister:         podsLister,
+		server:             server,
+		interval:           interval,
+		evict:              evict,
+		exemptionsRecorded: exemptionsRecorded,
+		trigger:            make(chan struct{}, 1),
+		reported:           make(map[string]bool),
+	}
+	nsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNS, newNS := oldObj.(*v1.Namespace), newObj.(*v1.Namespace)
+			for _, grant := range namespaceGrants {
+				if oldNS.Annotations[grant.allowAnn] != newNS.Annotations[grant.allowAnn] ||
+					oldNS.Annotations[grant.expireAnn] != newNS.Annotations[grant.expireAnn] {
+					vs.Trigger()
+					return
+				}
+			}
+		},
+	})
+	return vs
+}
+
+// Trigger starts a scan as soon as possible
+func (vs *ViolationScanner) Trigger() {
+	select {
+	case vs.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run scans the pods every interval and when triggered until stopCh is closed
+func (vs *ViolationScanner) Run(stopCh <-chan struct{}) {
+	glog.Infof("ViolationScanner started, interval:%v, evict:%t", vs.interval, vs.evict)
+	ticker := time.NewTicker(vs.interval)
+	defer ticker.Stop()
+	for {
+		vs.scan()
+		select {
+		case <-stopCh:
+			glog.Infof("ViolationScanner stopped")
+			return
+		case <-ticker.C:
+		case <-vs.trigger:
+		}
+	}
+}
+
+// ServeHTTP implements http.Handler interface to provide the report of the last scan.
+func (vs *ViolationScanner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vs.mu.Lock()
+	buf, err := json.Marshal(vs.report)
+	vs.mu.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+// getViolations checks the pod by the same rules as the admission, only the serviceaccount
+// exemptions can be checked for running pods.
+func (vs *ViolationScanner) getViolations(pod *v1.Pod, ns *v1.Namespace, now time.Time) ([]Violation, error) {
+	ret := []Violation{}
+	permissions, err := vs.server.getPodDeniedPermissions(pod, ns, now)
+	if err != nil || len(permissions) == 0 {
+		return ret, err
+	}
+	exemptions := vs.server.exemptions
+	if _, _, exempt := exemptions.match(pod, pod.Namespace, authenticationv1.UserInfo{}); exempt {
+		return ret, nil
+	}
+	unverified := pod.Annotations[PodExemptedByAnn] != "" || (vs.exemptionsRecorded == false && exemptions.hasUserExemptions())
+	for _, permission := range permissions {
+		ret = append(ret, Violation{Namespace: pod.Namespace, Pod: pod.Name, Permission: permission, Unverified: unverified})
+	}
+	return ret, nil
+}
+
+func (vs *ViolationScanner) scan() {
+	pods, err := vs.podsLister.List(labels.Everything())
+	if err != nil {
+		glog.Errorf("ViolationScanner list pods err:%v", err)
+		return
+	}
+	now := time.Now()
+	violations := []Violation{}
+	violatingPods := make(map[string]podViolation)
+	for _, pod := range pods {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed || pod.DeletionTimestamp != nil {
+			continue
+		}
+		ns, err := vs.namespacesLister.Get(pod.Namespace)
+		if err != nil {
+			glog.Errorf("ViolationScanner get namespace %s err:%v", pod.Namespace, err)
+			continue
+		}
+		podViolations, err := vs.getViolations(pod, ns, now)
+		if err != nil {
+			glog.Errorf("ViolationScanner check pod %s:%s err:%v", pod.Namespace, pod.Name, err)
+			continue
+		}
+		for _, violation := range podViolations {
+			violations = append(violations, violation)
+			violatingPods[fmt.Sprintf("%s:%s", pod.UID, violation.Permission)] = podViolation{pod: pod, permission: violation.Permission, unverified: violation.Unverified}
+		}
+	}
+
+	counts := make(map[Violation]int)
+	for _, violation := range violations {
+		counts[Violation{Namespace: violation.Namespace, Permission: violation.Permission}]++
+	}
+	metrics.ResetViolatingPods()
+	for key, count := range counts {
+		metrics.SetViolatingPods(key.Namespace, key.Permission, count)
+	}
+
+	vs.mu.Lock()
+	vs.report = ViolationReport{ScanTime: now, Violations: violations}
+	reported := vs.reported
+	vs.reported = make(map[string]bool, len(violatingPods))
+	for key := range violatingPods {
+		vs.reported[key] = true
+	}
+	vs.mu.Unlock()
+
+	for key, pv := range violatingPods {
+		// only the new violations are recorded
+		if reported[key] == false {
+			pod := pv.pod
+			message := fmt.Sprintf("pod uses %s which namespace %s does not allow any more", pv.permission, pod.Namespace)
+			if err := common.RecordEvent(vs.client, common.GetObjectReference("Pod", pod), eventComponent,
+				v1.EventTypeWarning, "PolicyViolation", message); err != nil {
+				glog.Errorf("ViolationScanner record event of pod %s:%s err:%v", pod.Namespace, pod.Name, err)
+			}
+		}
+	}
+	if vs.evict {
+		evicted := make(map[string]bool)
+		for _, pv := range violatingPods {
+			if evicted[string(pv.pod.UID)] || pv.unverified {
+				continue
+			}
+			evicted[string(pv.pod.UID)] = true
+			vs.evictPod(pv.pod)
+		}
+	}
+	glog.V(4).Infof("ViolationScanner found %d violations in %d pods", len(violations), len(pods))
+}
+
+func (vs *ViolationScanner) evictPod(pod *v1.Pod) {
+	eviction := &policyv1beta1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+	}
+	if err := vs.client.CoreV1().Pods(pod.Namespace).Evict(eviction); err != nil {
+		glog.Errorf("ViolationScanner evict pod %s:%s err:%v", pod.Namespace, pod.Name, err)
+		return
+	}
+	glog.Infof("ViolationScanner evicted pod %s:%s", pod.Namespace, pod.Name)
+}
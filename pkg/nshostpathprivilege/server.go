@@ -16,23 +16,24 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	"time"
 
 	"github.com/Rhealb/admission-controller/pkg/utils/metrics"
+	"github.com/Rhealb/extender-scheduler/pkg/algorithm"
 
 	"github.com/golang/glog"
 	"k8s.io/api/admission/v1beta1"
 	"k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
 )
 
 const (
@@ -40,14 +41,41 @@ const (
 	NamespaceAllowPrivilegeAnn = "io.enndata.namespace/alpha-allowprivilege"
 )
 
+const (
+	permissionHostPath  = "hostpath"
+	permissionPrivilege = "privilege"
+)
+
+var podResource = metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+
 type AdmissionServer struct {
 	client           *kubernetes.Clientset
 	namespacesLister corelisters.NamespaceLister
+	pvInfo           *algorithm.CachedPersistentVolumeInfo
+	pvcInfo          *algorithm.CachedPersistentVolumeClaimInfo
+	scLister         storagelisters.StorageClassLister
+	checkHostPathPV  bool
+	exemptions       *Exemptions
+
+	namespaceGetter   *NamespaceGetter
+	namespaceFailOpen bool
 }
 
 // NewAdmissionServer constructs new AdmissionServer
-func NewAdmissionServer(client *kubernetes.Clientset, namespacesLister corelisters.NamespaceLister) *AdmissionServer {
-	return &AdmissionServer{client: client, namespacesLister: namespacesLister}
+func NewAdmissionServer(client *kubernetes.Clientset, namespacesLister corelisters.NamespaceLister, pvLister corelisters.PersistentVolumeLister,
+	pvcLister corelisters.PersistentVolumeClaimLister, scLister storagelisters.StorageClassLister, checkHostPathPV bool, exemptions *Exemptions, namespaceWait time.Duration, namespaceFailOpen bool) *AdmissionServer {
+	return &AdmissionServer{
+		client:           client,
+		namespacesLister: namespacesLister,
+		pvInfo:           &algorithm.CachedPersistentVolumeInfo{PersistentVolumeLister: pvLister},
+		pvcInfo:          &algorithm.CachedPersistentVolumeClaimInfo{PersistentVolumeClaimLister: pvcLister},
+		scLister:         scLister,
+		checkHostPathPV:  checkHostPathPV,
+		exemptions:       exemptions,
+
+		namespaceGetter:   NewNamespaceGetter(namespacesLister, namespaceWait),
+		namespaceFailOpen: namespaceFailOpen,
+	}
 }
 
 func isPodUseHostPath(pod *v1.Pod) bool {
@@ -79,45 +107,61 @@ func isPodPrivilge(pod *v1.Pod) bool {
 	}
 	return false
 }
-func isNamespaceAllowHostPath(ns *v1.Namespace) bool {
-	if ns == nil || ns.Annotations == nil || ns.Annotations[NamespaceAllowHostPathAnn] != "true" {
-		return false
-	}
-	return true
-}
-func isNamespaceAllowPrivilege(ns *v1.Namespace) bool {
-	if ns == nil || ns.Annotations == nil || ns.Annotations[NamespaceAllowPrivilegeAnn] != "true" {
-		return false
-	}
-	return true
-}
 
-func (s *AdmissionServer) getNamespace(name string) (*v1.Namespace, error) {
-	ns, err := s.namespacesLister.Get(name)
-	if err == nil {
-		return ns, nil
-	}
-	if !errors.IsNotFound(err) {
-		return nil, err
+// getDeniedHostPathVolumes returns the indexes of the volumes of pod which use hostpath inline or through
+// the hostpath pvs, readOnly hostpath is allowed in mutate mode namespaces.
+func getDeniedHostPathVolumes(pod *v1.Pod, mode string, hostPathPVs map[string]string) []int {
+	ret := []int{}
+	hostPathVolumes := getHostPathVolumeNames(pod, hostPathPVs)
+	for i, volume := range pod.Spec.Volumes {
+		if hostPathVolumes[volume.Name] == false {
+			continue
+		}
+		if mode == namespaceModeMutate && isPodHostPathReadOnly(pod, map[string]bool{volume.Name: true}) {
+			continue
+		}
+		ret = append(ret, i)
 	}
+	return ret
+}
 
-	// Could not find in cache, attempt to look up directly
-	numAttempts := 3
-	retryInterval := time.Duration(rand.Int63n(100)+int64(100)) * time.Millisecond
-	for i := 0; i < numAttempts; i++ {
-		if i != 0 {
-			time.Sleep(retryInterval)
-		}
-		ns, err := s.client.Core().Namespaces().Get(name, metav1.GetOptions{})
-		if err == nil {
-			return ns, nil
+// getPodDeniedPermissions returns the permissions used by the pod which ns does not allow at now,
+// decided the same as admitPod except the exemptions.
+func (s *AdmissionServer) getPodDeniedPermissions(pod *v1.Pod, ns *v1.Namespace, now time.Time) ([]string, error) {
+	ret := []string{}
+	if isNamespaceGrantValid(ns, NamespaceAllowHostPathAnn, NamespaceAllowHostPathExpireAnn, now) == false {
+		hostPathPVs, err := s.getPodHostPathPVs(pod)
+		if err != nil {
+			return ret, err
 		}
-		if !errors.IsNotFound(err) {
-			return nil, err
+		if len(getDeniedHostPathVolumes(pod, getNamespaceMode(ns), hostPathPVs)) > 0 {
+			ret = append(ret, permissionHostPath)
 		}
 	}
+	if isPodPrivilge(pod) && isNamespaceGrantValid(ns, NamespaceAllowPrivilegeAnn, NamespaceAllowPrivilegeExpireAnn, now) == false {
+		ret = append(ret, permissionPrivilege)
+	}
+	return ret, nil
+}
 
-	return nil, nil
+func isNamespaceAllowHostPath(ns *v1.Namespace) bool {
+	return isNamespaceGrantValid(ns, NamespaceAllowHostPathAnn, NamespaceAllowHostPathExpireAnn, time.Now())
+}
+func isNamespaceAllowPrivilege(ns *v1.Namespace) bool {
+	return isNamespaceGrantValid(ns, NamespaceAllowPrivilegeAnn, NamespaceAllowPrivilegeExpireAnn, time.Now())
+}
+
+// isExempted checks whether the pod is allowed to use permission by an exemption,
+// the used exemption is recorded to metrics and auditAnnotations.
+func (s *AdmissionServer) isExempted(pod *v1.Pod, req *v1beta1.AdmissionRequest, permission string, auditAnnotations map[string]string) bool {
+	kind, name, exempt := s.exemptions.match(pod, req.Namespace, getPodCreator(req))
+	if exempt == false {
+		return false
+	}
+	glog.Infof("pod %s:%s use %s is exempted by %s %s", req.Namespace, req.Name, permission, kind, name)
+	metrics.OnExemptionUsed(kind, name, permission)
+	auditAnnotations[permission+"-exemption"] = fmt.Sprintf("%s=%s", kind, name)
+	return true
 }
 
 func toAdmissionResponse(err error, code int32) *v1beta1.AdmissionResponse {
@@ -135,10 +179,9 @@ func allowAdmissionResponse() *v1beta1.AdmissionResponse {
 	}
 }
 
-func (s *AdmissionServer) admit(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
-	if ar.Request == nil || ar.Request.Resource != podResource {
-		glog.Errorf("expect resource to be %s", podResource)
+func (s *AdmissionServer) admit(ctx context.Context, ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+	if ar.Request == nil || (ar.Request.Resource != podResource && isWorkloadResource(ar.Request.Resource) == false) {
+		glog.Errorf("expect resource to be %s or workload controllers", podResource)
 		return nil
 	}
 	if ar.Request.Operation != v1beta1.Create && ar.Request.Operation != v1beta1.Update {
@@ -146,38 +189,125 @@ func (s *AdmissionServer) admit(ar v1beta1.AdmissionReview) *v1beta1.AdmissionRe
 		return nil
 	}
 
-	pod := v1.Pod{}
-	if err := json.Unmarshal(ar.Request.Object.Raw, &pod); err != nil {
-		glog.Error(err)
-		return toAdmissionResponse(err, http.StatusInternalServerError)
+	var pod *v1.Pod
+	if ar.Request.Resource == podResource {
+		pod = &v1.Pod{}
+		if err := json.Unmarshal(ar.Request.Object.Raw, pod); err != nil {
+			glog.Error(err)
+			return toAdmissionResponse(err, http.StatusInternalServerError)
+		}
+		if pod.Namespace == "" {
+			pod.Namespace = ar.Request.Namespace
+		}
+	} else {
+		workloadPod, err := getWorkloadPod(ar.Request.Resource, ar.Request.Object.Raw, ar.Request.Namespace)
+		if err != nil {
+			glog.Error(err)
+			return toAdmissionResponse(err, http.StatusInternalServerError)
+		}
+		pod = workloadPod
 	}
+	return s.admitPod(ctx, pod, ar.Request)
+}
 
-	ns, errGet := s.getNamespace(ar.Request.Namespace)
+// admitPod checks whether the pod (or the pod template of a workload controller) is allowed
+// by the hostpath, privilege, volume type and pod security policies of its namespace.
+func (s *AdmissionServer) admitPod(ctx context.Context, pod *v1.Pod, req *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse {
+	ns, err := s.namespaceGetter.Get(ctx, req.Namespace)
+	if err != nil {
+		return s.namespaceLookupFailed(req, err)
+	}
+	auditAnnotations := make(map[string]string)
+	mode := getNamespaceMode(ns)
+	if mode == namespaceModeMutate && req.Resource != podResource && s.isExemptedNoRecord(pod, req) == false {
+		// the pods of workload controllers will be mutated when they are created, so the template is
+		// checked as mutated and only the checks which can not be fixed by the mutation may deny it
+		pod = pod.DeepCopy()
+		if _, err := s.mutatePod(pod, ns); err != nil {
+			return toAdmissionResponse(err, http.StatusInternalServerError)
+		}
+	}
 
-	useHostPath := isPodUseHostPath(&pod)
-	if useHostPath {
-		if ns == nil {
-			return toAdmissionResponse(fmt.Errorf("pod use hostpath get %s: %v", pod.Namespace, errGet), http.StatusInternalServerError)
+	violations := newPolicyViolations(getPodPath(req.Resource))
+	if valid, err := s.checkUserExemptionRecord(pod, req); err != nil {
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	} else if valid == false {
+		violations.add("metadata.annotations", fmt.Sprintf("annotation %s can only be set by the web hook", PodExemptedByAnn))
+	}
+	hostPathPVs, err := s.getPodHostPathPVs(pod)
+	if err != nil {
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	}
+	deniedHostPathVolumes := getDeniedHostPathVolumes(pod, mode, hostPathPVs)
+	if len(deniedHostPathVolumes) > 0 && isNamespaceAllowHostPath(ns) == false && s.isExempted(pod, req, permissionHostPath, auditAnnotations) == false {
+		for _, i := range deniedHostPathVolumes {
+			volume := pod.Spec.Volumes[i]
+			if pvName := hostPathPVs[volume.Name]; volume.HostPath == nil && pvName == "" {
+				violations.add(fmt.Sprintf("spec.volumes[%d].persistentVolumeClaim", i), fmt.Sprintf("volume %s: pv of pvc %s can not be resolved, it may be a hostpath pv", volume.Name, volume.PersistentVolumeClaim.ClaimName))
+			} else if volume.HostPath == nil {
+				violations.add(fmt.Sprintf("spec.volumes[%d].persistentVolumeClaim", i), fmt.Sprintf("volume %s: hostpath pv %s is not allowed", volume.Name, pvName))
+			} else {
+				violations.add(fmt.Sprintf("spec.volumes[%d].hostPath", i), fmt.Sprintf("volume %s: hostpath is not allowed", volume.Name))
+			}
 		}
-		if isNamespaceAllowHostPath(ns) == false {
-			return toAdmissionResponse(fmt.Errorf("namespace %s: not support hostpath", pod.Namespace), http.StatusInternalServerError)
+	}
+
+	if isPodPrivilge(pod) && isNamespaceAllowPrivilege(ns) == false && s.isExempted(pod, req, permissionPrivilege, auditAnnotations) == false {
+		containers, paths := getPodAllContainers(pod)
+		for i, c := range containers {
+			if c.SecurityContext != nil && c.SecurityContext.Privileged != nil && *c.SecurityContext.Privileged == true {
+				violations.add(paths[i]+".securityContext.privileged", fmt.Sprintf("container %s: privilege is not allowed", c.Name))
+			}
 		}
 	}
 
-	usePrivilege := isPodPrivilge(&pod)
-	if usePrivilege {
-		if ns == nil {
-			return toAdmissionResponse(fmt.Errorf("pod use privilege get %s: %v", pod.Namespace, errGet), http.StatusInternalServerError)
+	volumeViolations, err := s.getPodVolumeViolations(pod, ns)
+	if err != nil {
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	}
+	if len(volumeViolations) > 0 && s.isExempted(pod, req, permissionVolumeType, auditAnnotations) == false {
+		for _, v := range volumeViolations {
+			violations.add(fmt.Sprintf("spec.volumes[%d]", v.Index), v.String())
 		}
-		if isNamespaceAllowPrivilege(ns) == false {
-			return toAdmissionResponse(fmt.Errorf("namespace %s: not support privilege", pod.Namespace), http.StatusInternalServerError)
+	}
+
+	// the hostpath and privilege grants are the explicit exceptions of the pod security level
+	level := getNamespacePodSecurityLevel(ns)
+	allowed := map[string]bool{
+		permissionHostPath:  isNamespaceAllowHostPath(ns) || auditAnnotations[permissionHostPath+"-exemption"] != "",
+		permissionPrivilege: isNamespaceAllowPrivilege(ns) || auditAnnotations[permissionPrivilege+"-exemption"] != "",
+	}
+	if podSecurityViolations := evaluatePodSecurity(pod, level, allowed); len(podSecurityViolations) > 0 {
+		if s.isExempted(pod, req, permissionPodSecurity, auditAnnotations) == false {
+			for _, v := range podSecurityViolations {
+				violations.add(v.Field, formatPodSecurityViolations(level, []PodSecurityViolation{v}))
+			}
+		} else {
+			auditAnnotations[permissionPodSecurity+"-violations"] = getPodSecurityCheckNames(podSecurityViolations)
 		}
 	}
-	return allowAdmissionResponse()
+
+	if violations.empty() == false {
+		return violations.toAdmissionResponse(req)
+	}
+	response := allowAdmissionResponse()
+	if len(auditAnnotations) > 0 {
+		response.AuditAnnotations = auditAnnotations
+	}
+	return response
 }
 
 // Serve is a handler function of AdmissionServer
 func (s *AdmissionServer) Serve(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, s.admit)
+}
+
+// ServeMutate is a handler function of AdmissionServer for the mutate mode
+func (s *AdmissionServer) ServeMutate(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, s.mutate)
+}
+
+func serve(w http.ResponseWriter, r *http.Request, admit func(ctx context.Context, ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse) {
 	timer := metrics.NewAdmissionLatency()
 
 	var body []byte
@@ -205,7 +335,9 @@ func (s *AdmissionServer) Serve(w http.ResponseWriter, r *http.Request) {
 		timer.Observe(metrics.Error, metrics.Unknown)
 		return
 	}
-	reviewResponse := s.admit(ar)
+	ctx, cancel := getRequestContext(r)
+	defer cancel()
+	reviewResponse := admit(ctx, ar)
 	response := v1beta1.AdmissionReview{
 		Response: reviewResponse,
 	}
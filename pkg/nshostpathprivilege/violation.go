@@ -0,0 +1,107 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// causeTypeForbidden is the same as the type of the field.Forbidden errors
+const causeTypeForbidden metav1.CauseType = "FieldValueForbidden"
+
+var fieldIndexRegexp = regexp.MustCompile(`\[\d+\]`)
+
+// getFieldPattern replaces the indexes of field with [*] as the fields of the pod security checks,
+// which cover the init containers by spec.containers[*] too.
+func getFieldPattern(field string) string {
+	field = strings.Replace(field, "spec.initContainers[", "spec.containers[", 1)
+	return fieldIndexRegexp.ReplaceAllString(field, "[*]")
+}
+
+// policyViolations collects all the rules violated by a pod so that they can be fixed in one iteration
+type policyViolations struct {
+	// podPath is the field path of the pod (template) in the admitted object
+	podPath string
+	causes  []metav1.StatusCause
+}
+
+func newPolicyViolations(podPath string) *policyViolations {
+	return &policyViolations{podPath: podPath}
+}
+
+// add records a violation, field is the path relative to the pod, such as spec.volumes[0].hostPath.
+// A violation of a field which is recorded already is skipped, so is a violation of a field
+// pattern (such as spec.containers[*].securityContext.privileged) matching a recorded field.
+func (pv *policyViolations) add(field, message string) {
+	path := field
+	if pv.podPath != "" {
+		path = pv.podPath + "." + field
+	}
+	for _, cause := range pv.causes {
+		if cause.Field == path || (strings.Contains(path, "[*]") && getFieldPattern(cause.Field) == path) {
+			return
+		}
+	}
+	pv.causes = append(pv.causes, metav1.StatusCause{
+		Type:    causeTypeForbidden,
+		Message: message,
+		Field:   path,
+	})
+}
+
+func (pv *policyViolations) empty() bool {
+	return len(pv.causes) == 0
+}
+
+// toAdmissionResponse returns a 403 Forbidden denial which lists all the violations in Details.Causes
+func (pv *policyViolations) toAdmissionResponse(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse {
+	messages := make([]string, 0, len(pv.causes))
+	for _, cause := range pv.causes {
+		messages = append(messages, fmt.Sprintf("%s: %s", cause.Field, cause.Message))
+	}
+	return &v1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusForbidden,
+			Reason:  metav1.StatusReasonForbidden,
+			Message: fmt.Sprintf("namespace %s: %s", req.Namespace, strings.Join(messages, "; ")),
+			Details: &metav1.StatusDetails{
+				Name:   req.Name,
+				Group:  req.Kind.Group,
+				Kind:   req.Kind.Kind,
+				Causes: pv.causes,
+			},
+		},
+	}
+}
+
+// getPodPath returns the field path of the pod (template) in the object of resource
+func getPodPath(resource metav1.GroupVersionResource) string {
+	switch {
+	case resource == podResource:
+		return ""
+	case resource.Resource == "cronjobs":
+		return "spec.jobTemplate.spec.template"
+	}
+	return "spec.template"
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// NamespaceAllowVolumeTypesAnn lists the volume types (json names of the volume sources, such as nfs,rbd,flexVolume)
+	// the pods of namespace can use, separated by ','. All types are allowed if it is not set.
+	NamespaceAllowVolumeTypesAnn = "io.enndata.namespace/alpha-allowvolumetypes"
+	// NamespaceAllowCSIDriversAnn lists the csi drivers (such as xfshostpathplugin) the pods of namespace can use
+	// through pvcs, separated by ','. All drivers are allowed if it is not set.
+	NamespaceAllowCSIDriversAnn = "io.enndata.namespace/alpha-allowcsidrivers"
+
+	permissionVolumeType = "volumetype"
+
+	volumeTypeHostPath = "hostPath"
+	volumeTypeCSI      = "csi"
+)
+
+// defaultVolumeTypes are always allowed, hostPath is controlled by NamespaceAllowHostPathAnn
+// and persistentVolumeClaim is checked by the type of its pv.
+var defaultVolumeTypes = map[string]bool{
+	"configMap":             true,
+	"secret":                true,
+	"downwardAPI":           true,
+	"projected":             true,
+	"emptyDir":              true,
+	"persistentVolumeClaim": true,
+	volumeTypeHostPath:      true,
+}
+
+// VolumeViolation is a pod volume which uses a volume type or csi driver not allowed by the namespace
+type VolumeViolation struct {
+	// Index is the index of the volume in the pod spec
+	Index  int
+	Volume string
+	PV     string
+	Type   string
+	Driver string
+	// Claim is set if the pv of the pvc can not be resolved
+	Claim string
+}
+
+func (v VolumeViolation) String() string {
+	if v.Claim != "" {
+		return fmt.Sprintf("volume %s uses pvc %s whose pv can not be resolved", v.Volume, v.Claim)
+	}
+	if v.Type == "" {
+		return fmt.Sprintf("volume %s uses pv %s whose volume type is unknown", v.Volume, v.PV)
+	}
+	if v.Driver != "" {
+		return fmt.Sprintf("volume %s uses not allowed csi driver %s (pv %s)", v.Volume, v.Driver, v.PV)
+	}
+	if v.PV != "" {
+		return fmt.Sprintf("volume %s uses not allowed volume type %s (pv %s)", v.Volume, v.Type, v.PV)
+	}
+	return fmt.Sprintf("volume %s uses not allowed volume type %s", v.Volume, v.Type)
+}
+
+// getNamespaceAllowList returns nil if the annotation is not set which means all are allowed
+func getNamespaceAllowList(ns *v1.Namespace, ann string) map[string]struct{} {
+	if ns == nil || ns.Annotations == nil {
+		return nil
+	}
+	value, exist := ns.Annotations[ann]
+	if exist == false {
+		return nil
+	}
+	return toStrMap(strings.Split(value, ","))
+}
+
+func isVolumeTypeAllowed(allowedTypes map[string]struct{}, volumeType string) bool {
+	if allowedTypes == nil || defaultVolumeTypes[volumeType] {
+		return true
+	}
+	_, exist := allowedTypes[volumeType]
+	return exist
+}
+
+// getPodVolumeViolations checks the inline volumes and the pvs bound through pvcs of pod
+// against the volume types and csi drivers allowed by the namespace.
+func (s *AdmissionServer) getPodVolumeViolations(pod *v1.Pod, ns *v1.Namespace) ([]VolumeViolation, error) {
+	ret := []VolumeViolation{}
+	allowedTypes := getNamespaceAllowList(ns, NamespaceAllowVolumeTypesAnn)
+	allowedDrivers := getNamespaceAllowList(ns, NamespaceAllowCSIDriversAnn)
+	if allowedTypes == nil && allowedDrivers == nil {
+		return ret, nil
+	}
+	for i, volume := range pod.Spec.Volumes {
+		volumeType := getVolumeSourceType(volume.VolumeSource)
+		if isVolumeTypeAllowed(allowedTypes, volumeType) == false {
+			ret = append(ret, VolumeViolation{Index: i, Volume: volume.Name, Type: volumeType})
+			continue
+		}
+		pv, err := s.getPodVolumePV(pod, volume)
+		if err != nil {
+			return ret, fmt.Errorf("get pod %s:%s volume %s pv err:%v", pod.Namespace, pod.Name, volume.Name, err)
+		}
+		// the pvs which are not resolved or of unknown types are denied only by the volume type allowlist,
+		// the csi driver allowlist only applies to the resolved csi pvs
+		if volume.PersistentVolumeClaim != nil && pv == nil {
+			if allowedTypes == nil {
+				continue
+			}
+			ret = append(ret, VolumeViolation{Index: i, Volume: volume.Name, Type: volumeType, Claim: volume.PersistentVolumeClaim.ClaimName})
+			continue
+		}
+		if pv == nil {
+			continue
+		}
+		pvType := getVolumeSourceType(pv.Spec.PersistentVolumeSource)
+		if (pvType == "" && allowedTypes != nil) || isVolumeTypeAllowed(allowedTypes, pvType) == false {
+			ret = append(ret, VolumeViolation{Index: i, Volume: volume.Name, PV: pv.Name, Type: pvType})
+			continue
+		}
+		if pvType == volumeTypeCSI && allowedDrivers != nil {
+			if _, exist := allowedDrivers[pv.Spec.CSI.Driver]; exist == false {
+				ret = append(ret, VolumeViolation{Index: i, Volume: volume.Name, PV: pv.Name, Type: pvType, Driver: pv.Spec.CSI.Driver})
+			}
+		}
+	}
+	return ret, nil
+}
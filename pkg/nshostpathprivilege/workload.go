@@ -0,0 +1,116 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// workloadGroups are the api groups of the workload controllers whose pod template is checked,
+// the pod template is the same in all versions of a group so the objects are decoded by the newest one.
+var workloadGroups = map[string]bool{
+	"apps":       true,
+	"extensions": true,
+	"batch":      true,
+}
+
+func isWorkloadResource(resource metav1.GroupVersionResource) bool {
+	if workloadGroups[resource.Group] == false {
+		return false
+	}
+	switch resource.Resource {
+	case "deployments", "statefulsets", "daemonsets", "replicasets", "jobs", "cronjobs":
+		return true
+	}
+	return false
+}
+
+// getWorkloadPodTemplate decodes the workload controller object raw and returns its pod template
+func getWorkloadPodTemplate(resource metav1.GroupVersionResource, raw []byte) (*v1.PodTemplateSpec, error) {
+	switch resource.Resource {
+	case "deployments":
+		obj := appsv1.Deployment{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		return &obj.Spec.Template, nil
+	case "statefulsets":
+		obj := appsv1.StatefulSet{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		return &obj.Spec.Template, nil
+	case "daemonsets":
+		obj := appsv1.DaemonSet{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		return &obj.Spec.Template, nil
+	case "replicasets":
+		obj := appsv1.ReplicaSet{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		return &obj.Spec.Template, nil
+	case "jobs":
+		obj := batchv1.Job{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		return &obj.Spec.Template, nil
+	case "cronjobs":
+		obj := batchv1beta1.CronJob{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		return &obj.Spec.JobTemplate.Spec.Template, nil
+	}
+	return nil, fmt.Errorf("unsupported workload resource %s", resource)
+}
+
+// getPodCreator returns the user creating the pod of req. The pods of the workload controllers are
+// created by the controllers instead of the user applying them, so no user is returned for them and
+// only the serviceaccount exemptions apply to their pod templates.
+func getPodCreator(req *v1beta1.AdmissionRequest) authenticationv1.UserInfo {
+	if req.Resource != podResource {
+		return authenticationv1.UserInfo{}
+	}
+	return req.UserInfo
+}
+
+// getWorkloadPod builds a pod from the pod template of the workload controller so that
+// it can be checked the same as the pods created by the controller.
+func getWorkloadPod(resource metav1.GroupVersionResource, raw []byte, namespace string) (*v1.Pod, error) {
+	template, err := getWorkloadPodTemplate(resource, raw)
+	if err != nil {
+		return nil, err
+	}
+	pod := &v1.Pod{
+		ObjectMeta: template.ObjectMeta,
+		Spec:       template.Spec,
+	}
+	pod.Namespace = namespace
+	return pod, nil
+}
@@ -16,19 +16,17 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"sort"
 
+	"github.com/Rhealb/admission-controller/pkg/common"
 	"github.com/Rhealb/admission-controller/pkg/utils/metrics"
 	"github.com/Rhealb/extender-scheduler/pkg/algorithm"
 
 	"github.com/golang/glog"
-	"github.com/mattbaird/jsonpatch"
 	"k8s.io/api/admission/v1beta1"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -160,7 +158,7 @@ func (s *AdmissionServer) admit(ar v1beta1.AdmissionReview) *v1beta1.AdmissionRe
 	pod.Spec.Priority = &priority
 	if newPodJson, err := json.Marshal(&pod); err != nil {
 		return toAdmissionResponse(err, http.StatusInternalServerError)
-	} else if patch, errPath := createPatch(ar.Request.Object.Raw, newPodJson); errPath != nil {
+	} else if patch, errPath := common.CreatePatch(ar.Request.Object.Raw, newPodJson); errPath != nil {
 		return toAdmissionResponse(errPath, http.StatusInternalServerError)
 	} else {
 		var patchType = v1beta1.PatchTypeJSONPatch
@@ -222,26 +220,3 @@ func (s *AdmissionServer) Serve(w http.ResponseWriter, r *http.Request) {
 
 	timer.Observe(metrics.Applied, metrics.Pod)
 }
-
-func createPatch(oldPod, newPod []byte) ([]byte, error) {
-	patchOperations, err := jsonpatch.CreatePatch(oldPod, newPod)
-	if err != nil {
-		return nil, err
-	}
-	sort.Sort(jsonpatch.ByPath(patchOperations))
-	var b bytes.Buffer
-	b.WriteString("[")
-	l := len(patchOperations)
-	for i, patchOperation := range patchOperations {
-		buf, err := patchOperation.MarshalJSON()
-		if err != nil {
-			return nil, err
-		}
-		b.Write(buf)
-		if i < l-1 {
-			b.WriteString(",")
-		}
-	}
-	b.WriteString("]")
-	return b.Bytes(), nil
-}
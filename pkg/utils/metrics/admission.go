@@ -73,12 +73,48 @@ var (
 			Buckets:   []float64{0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1.0, 2.0, 5.0, 10.0, 20.0, 30.0, 60.0, 120.0, 300.0},
 		}, []string{"status", "resource"},
 	)
+
+	exemptionCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "exemptions_total",
+			Help:      "Number of requests allowed by an exemption of k8s-plugins Admission Controller.",
+		}, []string{"kind", "name", "permission"},
+	)
+
+	violatingPods = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "violating_pods",
+			Help:      "Number of running Pods which use a permission their namespace does not allow any more.",
+		}, []string{"namespace", "permission"},
+	)
+
+	schedulerAvailable = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "scheduler_available",
+			Help:      "Whether the custom scheduler which the Pods are routed to is available (1) or not (0).",
+		}, []string{"scheduler"},
+	)
+
+	schedulerFallbackCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "scheduler_fallbacks_total",
+			Help:      "Number of Pods rejected or routed to the default scheduler because their custom scheduler is unavailable.",
+		}, []string{"scheduler", "action"},
+	)
 )
 
 // Register initializes all metrics for k8s-plugins Admission Contoller
 func Register() {
 	prometheus.MustRegister(admissionCount)
 	prometheus.MustRegister(admissionLatency)
+	prometheus.MustRegister(exemptionCount)
+	prometheus.MustRegister(violatingPods)
+	prometheus.MustRegister(schedulerAvailable)
+	prometheus.MustRegister(schedulerFallbackCount)
 }
 
 // OnAdmittedPod increases the counter of pods handled by k8s-plugins Admission Controller
@@ -86,6 +122,35 @@ func OnAdmittedPod(touched bool) {
 	admissionCount.WithLabelValues(fmt.Sprintf("%v", touched)).Add(1)
 }
 
+// OnExemptionUsed increases the counter of requests allowed by the exemption kind:name for permission
+func OnExemptionUsed(kind, name, permission string) {
+	exemptionCount.WithLabelValues(kind, name, permission).Add(1)
+}
+
+// ResetViolatingPods clears the numbers of violating pods before a new scan result is set
+func ResetViolatingPods() {
+	violatingPods.Reset()
+}
+
+// SetViolatingPods sets the number of violating pods using permission in namespace
+func SetViolatingPods(namespace, permission string, count int) {
+	violatingPods.WithLabelValues(namespace, permission).Set(float64(count))
+}
+
+// SetSchedulerAvailable sets whether the scheduler is available
+func SetSchedulerAvailable(scheduler string, available bool) {
+	value := 0.0
+	if available {
+		value = 1.0
+	}
+	schedulerAvailable.WithLabelValues(scheduler).Set(value)
+}
+
+// OnSchedulerFallback increases the counter of pods handled by action because scheduler is unavailable
+func OnSchedulerFallback(scheduler, action string) {
+	schedulerFallbackCount.WithLabelValues(scheduler, action).Add(1)
+}
+
 // NewAdmissionLatency provides a timer for admission latency; call Observe() on it to measure
 func NewAdmissionLatency() *AdmissionLatency {
 	return &AdmissionLatency{